@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bearerPrefix prefixes the token in the Authorization header.
+const bearerPrefix = "Bearer "
+
+// bearerToken returns the bearer token of the request, empty when it carries none.
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(authorization, bearerPrefix)
+}
+
+// authorizeAdmin checks that the request carries the admin token as a bearer token, otherwise it responds with a 401
+// when the token is missing or a 403 when it is wrong and returns false. Admin endpoints are disabled, and always
+// respond with a 403, when the admin token is empty.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, adminToken string) bool {
+	token := bearerToken(r)
+	if token == "" {
+		writeErr(w, http.StatusUnauthorized, "an admin token is required.")
+		return false
+	}
+
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeErr(w, http.StatusForbidden, "the admin token is not valid.")
+		return false
+	}
+
+	return true
+}
+
+// ParseCallerTokens parses the API tokens of the callers allowed to read unmasked logins, given as comma separated
+// caller:token pairs, into a map of the caller by token.
+func ParseCallerTokens(tokens string) (map[string]string, error) {
+	callers := make(map[string]string)
+	for _, pair := range strings.Split(tokens, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		caller, token, found := strings.Cut(pair, ":")
+		if !found || caller == "" || token == "" {
+			return nil, errors.New(fmt.Sprintf("caller token %q is not of the form caller:token", pair))
+		}
+
+		if _, exists := callers[token]; exists {
+			return nil, errors.New(fmt.Sprintf("duplicate token of caller %q", caller))
+		}
+
+		callers[token] = caller
+	}
+
+	return callers, nil
+}
+
+// authenticateCaller returns the caller whose API token the request carries as a bearer token, otherwise it responds
+// with a 401 when the token is missing or a 403 when it is unknown and returns false.
+func authenticateCaller(w http.ResponseWriter, r *http.Request, callerTokens map[string]string) (string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		writeErr(w, http.StatusUnauthorized, "an API token is required to read unmasked logins.")
+		return "", false
+	}
+
+	// Every token is compared so that the time taken does not tell which one is closest.
+	var caller string
+	for callerToken, callerName := range callerTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(callerToken)) == 1 {
+			caller = callerName
+		}
+	}
+
+	if caller == "" {
+		writeErr(w, http.StatusForbidden, "the API token is not valid.")
+		return "", false
+	}
+
+	return caller, true
+}
+
+// writeErr responds with the status code and a JSON responseErr.
+func writeErr(w http.ResponseWriter, statusCode int, message string) {
+	errResp, _ := json.Marshal(responseErr{StatusCode: statusCode, Err: message})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(errResp)
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/shivasaicharanruthala/dataops-takehome/api/store"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"net/http"
+	"strconv"
+)
+
+type decryptionAuditHandler struct {
+	auditStore store.DecryptionAudit
+	adminToken string
+}
+
+// NewDecryptionAudit creates the admin handler of the decryption audit trail, requests must carry the admin token as
+// a bearer token. The endpoint is disabled when the admin token is empty.
+func NewDecryptionAudit(auditStore store.DecryptionAudit, adminToken string) *decryptionAuditHandler {
+	return &decryptionAuditHandler{
+		auditStore: auditStore,
+		adminToken: adminToken,
+	}
+}
+
+// Get responds with the audit records of the requests that returned unmasked logins, the most recent first,
+// optionally only those of a caller.
+func (ah decryptionAuditHandler) Get(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, ah.adminToken) {
+		return
+	}
+
+	limit := r.URL.Query().Get("limit")
+	page := r.URL.Query().Get("page")
+
+	limitConv, limitErr := strconv.Atoi(limit)
+	pageConv, pageErr := strconv.Atoi(page)
+	if limitErr != nil || pageErr != nil || limitConv < 0 || pageConv < 0 {
+		errResp, _ := json.Marshal(responseErr{StatusCode: 400, Err: "query params limit or page is missing."})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(errResp)
+		return
+	}
+
+	filter := model.DecryptionAuditFilter{
+		Limit:  limitConv,
+		Page:   pageConv,
+		Caller: r.URL.Query().Get("caller"),
+	}
+
+	resp, err := ah.auditStore.Get(r.Context(), &filter)
+	if err != nil {
+		errResp, _ := json.Marshal(responseErr{StatusCode: 500, Err: err.Error()})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(errResp)
+		return
+	}
+
+	respJson, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, _ = w.Write(respJson)
+}
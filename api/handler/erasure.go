@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/shivasaicharanruthala/dataops-takehome/etl"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"net/http"
+)
+
+type erasureHandler struct {
+	eraser     etl.Eraser
+	adminToken string
+}
+
+// NewErasure creates the admin handler of the right-to-be-forgotten requests, requests must carry the admin token as
+// a bearer token. The endpoint is disabled when the admin token is empty.
+func NewErasure(eraser etl.Eraser, adminToken string) *erasureHandler {
+	return &erasureHandler{
+		eraser:     eraser,
+		adminToken: adminToken,
+	}
+}
+
+// Create acts on a right-to-be-forgotten request, given as a JSON model.ErasureRequest, by deleting all the data of
+// the user and responds with the audit record of the erasure.
+func (eh erasureHandler) Create(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, eh.adminToken) {
+		return
+	}
+
+	var request model.ErasureRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.UserID == "" || request.RequestedBy == "" {
+		errResp, _ := json.Marshal(responseErr{StatusCode: 400, Err: "body must be a JSON object with user_id and requested_by."})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(errResp)
+		return
+	}
+
+	erasure, err := eh.eraser.Erase(r.Context(), &request)
+	if err != nil {
+		errResp, _ := json.Marshal(responseErr{StatusCode: 500, Err: err.Error()})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(errResp)
+		return
+	}
+
+	respJson, _ := json.Marshal(erasure)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(respJson)
+}
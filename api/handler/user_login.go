@@ -6,15 +6,25 @@ import (
 	"github.com/shivasaicharanruthala/dataops-takehome/model"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type loginHandler struct {
-	loginStore store.Login
+	loginStore   store.Login
+	auditStore   store.DecryptionAudit
+	masker       model.Masker
+	callerTokens map[string]string
 }
 
-func New(loginStore store.Login) *loginHandler {
+// New creates the handler of the logins, unmasked logins are recorded in the audit store, the masker computing the
+// blind indexes of the searched values recorded there. Unmasked logins are only returned to the callers presenting
+// one of the callerTokens, a map of the caller by API token, as a bearer token.
+func New(loginStore store.Login, auditStore store.DecryptionAudit, masker model.Masker, callerTokens map[string]string) *loginHandler {
 	return &loginHandler{
-		loginStore: loginStore,
+		loginStore:   loginStore,
+		auditStore:   auditStore,
+		masker:       masker,
+		callerTokens: callerTokens,
 	}
 }
 
@@ -31,6 +41,10 @@ func (lh loginHandler) Get(w http.ResponseWriter, r *http.Request) {
 	isEncrypted := r.URL.Query().Get("isEncrypted")
 	groupDuplicates := r.URL.Query().Get("groupDuplicates")
 
+	// Optional equality search on the PII fields
+	filter.IP = r.URL.Query().Get("ip")
+	filter.DeviceID = r.URL.Query().Get("deviceId")
+
 	if groupDuplicates != "" {
 		groupDuplicatesConv, _ := strconv.ParseBool(groupDuplicates)
 		filter.GroupDuplicates = groupDuplicatesConv
@@ -53,7 +67,18 @@ func (lh loginHandler) Get(w http.ResponseWriter, r *http.Request) {
 	filter.Page = pageConv
 	filter.IsEncrypted = isEncryptedConv
 
-	resp, err := lh.loginStore.Get(&filter)
+	// Unmasked logins are only returned to authenticated callers, who are recorded in the audit trail, and so are the
+	// searches by IP or device id, which reveal whether a login with the searched value exists.
+	var caller string
+	if !filter.IsEncrypted || filter.SearchesPII() {
+		var ok bool
+		caller, ok = authenticateCaller(w, r, lh.callerTokens)
+		if !ok {
+			return
+		}
+	}
+
+	resp, err := lh.loginStore.Get(r.Context(), &filter)
 	if err != nil {
 		errResp, _ := json.Marshal(responseErr{StatusCode: 400, Err: err.Error()})
 
@@ -63,8 +88,41 @@ func (lh loginHandler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Unmasked logins and the results of searches by IP or device id are only returned once the request is recorded
+	// in the audit trail.
+	if !filter.IsEncrypted || filter.SearchesPII() {
+		err = lh.audit(r, caller, &filter, resp)
+		if err != nil {
+			errResp, _ := json.Marshal(responseErr{StatusCode: 500, Err: "recording the decryption audit failed."})
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write(errResp)
+			return
+		}
+	}
+
 	respJson, _ := json.Marshal(resp)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	_, _ = w.Write(respJson)
 }
+
+// audit records the caller of the request, its filter and the logins it returned, unmasked or found by their IP or
+// device id.
+func (lh loginHandler) audit(r *http.Request, caller string, filter *model.Filter, logins []model.Response) error {
+	audit := model.DecryptionAudit{
+		Caller:      caller,
+		RemoteAddr:  r.RemoteAddr,
+		RequestedAt: time.Now().UTC(),
+		Filter:      filter.Audited(lh.masker),
+		RowCount:    len(logins),
+	}
+
+	// Logins flagged UnmaskFailed are recorded as well, the fields that could be unmasked are returned in plaintext.
+	for _, login := range logins {
+		audit.LoginIds = append(audit.LoginIds, login.LoginId)
+	}
+
+	return lh.auditStore.Record(r.Context(), &audit)
+}
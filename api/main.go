@@ -8,7 +8,9 @@ import (
 	"github.com/shivasaicharanruthala/dataops-takehome/api/handler"
 	"github.com/shivasaicharanruthala/dataops-takehome/api/store"
 	"github.com/shivasaicharanruthala/dataops-takehome/database"
+	"github.com/shivasaicharanruthala/dataops-takehome/etl"
 	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
 	"net/http"
 	"os"
 )
@@ -22,6 +24,16 @@ func init() {
 }
 func main() {
 	encryptionKey := os.Getenv("ENCRYPTION_SECRET")
+	encryptionKeys := os.Getenv("ENCRYPTION_KEYS")
+	activeKeyID := os.Getenv("ENCRYPTION_ACTIVE_KEY_ID")
+	blindIndexSecret := os.Getenv("BLIND_INDEX_SECRET")
+	keyProvider := os.Getenv("KEY_PROVIDER")
+	keyFile := os.Getenv("KEY_FILE")
+	kmsEndpoint := os.Getenv("KMS_ENDPOINT")
+	kmsToken := os.Getenv("KMS_TOKEN")
+	maskingPolicyFile := os.Getenv("MASKING_POLICY_FILE")
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	apiTokens := os.Getenv("API_TOKENS")
 
 	// Initialize Logger
 	logger, err := log.NewCustomLogger("../../app_logs")
@@ -44,11 +56,82 @@ func main() {
 		return
 	}
 
-	loginStore := store.New(dbConn, encryptionKey)
-	loginHandler := handler.New(loginStore)
+	// ENCRYPTION_SECRET and ENCRYPTION_KEYS hold the master keys of the env key provider, with the other providers they
+	// are only needed to unmask values written before envelope encryption.
+	var keyring *model.Keyring
+	if encryptionKey != "" || encryptionKeys != "" {
+		keyring, err = model.ParseKeyring(encryptionKey, encryptionKeys, activeKeyID)
+		if err != nil {
+			lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Initiating keyring failed with error %v", err.Error())}
+			logger.Log(&lm)
+
+			return
+		}
+	}
+
+	provider, err := model.NewKeyProvider(model.KeyProviderConfig{
+		Provider:    keyProvider,
+		KeyFile:     keyFile,
+		KMSEndpoint: kmsEndpoint,
+		KMSToken:    kmsToken,
+		Keyring:     keyring,
+	})
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Initiating key provider failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	masker, err := model.NewMasker(provider, database.NewDataKeyStore(logger, dbConn), database.NewVault(logger, dbConn), keyring, blindIndexSecret)
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Initiating masker failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	policy, err := model.LoadMaskingPolicy(maskingPolicyFile)
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Loading masking policy failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	// Drop the data keys shredded by other instances, e.g. the erase command, from the cache of the masker.
+	err = db.Listen(database.DataKeyShreddedChannel, func(id string) {
+		if id == "" {
+			masker.ForgetDataKeys()
+		} else {
+			masker.ForgetDataKeys(id)
+		}
+	})
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Listening to shredded data keys failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	callerTokens, err := handler.ParseCallerTokens(apiTokens)
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Parsing API_TOKENS failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	loginStore := store.New(logger, dbConn, masker, policy)
+	auditStore := store.NewDecryptionAudit(logger, dbConn)
+	loginHandler := handler.New(loginStore, auditStore, masker, callerTokens)
+	auditHandler := handler.NewDecryptionAudit(auditStore, adminToken)
+	erasureHandler := handler.NewErasure(etl.NewEraser(logger, dbConn, masker, policy), adminToken)
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/login-data", loginHandler.Get).Methods("GET")
+	router.HandleFunc("/erasures", erasureHandler.Create).Methods("POST")
+	router.HandleFunc("/admin/decryption-audit", auditHandler.Get).Methods("GET")
 
 	// Start the server
 	port := os.Getenv("PORT")
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+
+	"github.com/lib/pq"
+)
+
+type decryptionAuditStore struct {
+	logger *log.CustomLogger
+	dbConn *sql.DB
+}
+
+// NewDecryptionAudit creates a new instance of the DecryptionAudit backed by the decryption_audit table, which rejects
+// updates and deletes.
+func NewDecryptionAudit(logger *log.CustomLogger, dbConn *sql.DB) DecryptionAudit {
+	return &decryptionAuditStore{
+		logger: logger,
+		dbConn: dbConn,
+	}
+}
+
+// Record appends the audit record and sets its id.
+func (d decryptionAuditStore) Record(ctx context.Context, audit *model.DecryptionAudit) error {
+	filter, err := json.Marshal(audit.Filter)
+	if err != nil {
+		return err
+	}
+
+	if audit.LoginIds == nil {
+		audit.LoginIds = []int64{}
+	}
+
+	err = d.dbConn.QueryRowContext(ctx, "INSERT INTO decryption_audit (caller, remote_addr, requested_at, filter, row_count, login_ids) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		audit.Caller, audit.RemoteAddr, audit.RequestedAt, filter, audit.RowCount, pq.Array(audit.LoginIds)).Scan(&audit.Id)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to record decryption audit with error : %v", err.Error())}
+		d.logger.Log(&lm)
+
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the audit records of the filter, the most recent first.
+func (d decryptionAuditStore) Get(ctx context.Context, filter *model.DecryptionAuditFilter) ([]model.DecryptionAudit, error) {
+	audits := []model.DecryptionAudit{}
+
+	query := "SELECT id, caller, remote_addr, requested_at, filter, row_count, login_ids FROM decryption_audit"
+	args := []interface{}{filter.Limit, filter.Page * filter.Limit}
+	if filter.Caller != "" {
+		query += " WHERE caller = $3"
+		args = append(args, filter.Caller)
+	}
+
+	rows, err := d.dbConn.QueryContext(ctx, query+" ORDER BY requested_at DESC, id DESC LIMIT $1 OFFSET $2", args...)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error fetching decryption audit: %v", err.Error()))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var audit model.DecryptionAudit
+		var auditFilter []byte
+		var loginIds pq.Int64Array
+
+		err = rows.Scan(&audit.Id, &audit.Caller, &audit.RemoteAddr, &audit.RequestedAt, &auditFilter, &audit.RowCount, &loginIds)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error fetching decryption audit: %v", err.Error()))
+		}
+
+		err = json.Unmarshal(auditFilter, &audit.Filter)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error fetching decryption audit: %v", err.Error()))
+		}
+
+		audit.LoginIds = loginIds
+		audits = append(audits, audit)
+	}
+
+	return audits, rows.Err()
+}
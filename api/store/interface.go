@@ -1,7 +1,16 @@
 package store
 
-import "github.com/shivasaicharanruthala/dataops-takehome/model"
+import (
+	"context"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+)
 
 type Login interface {
-	Get(filter *model.Filter) ([]model.Response, error)
+	Get(ctx context.Context, filter *model.Filter) ([]model.Response, error)
+}
+
+// DecryptionAudit is the append-only audit trail of the logins returned unmasked by the API.
+type DecryptionAudit interface {
+	Record(ctx context.Context, audit *model.DecryptionAudit) error
+	Get(ctx context.Context, filter *model.DecryptionAuditFilter) ([]model.DecryptionAudit, error)
 }
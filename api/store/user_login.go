@@ -1,35 +1,83 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
 	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"strings"
 )
 
 type loginStore struct {
-	dbConn        *sql.DB
-	encryptionKey string
+	logger *log.CustomLogger
+	dbConn *sql.DB
+	masker model.Masker
+	policy *model.MaskingPolicy
 }
 
-func New(dbConn *sql.DB, encryptionKey string) Login {
+func New(logger *log.CustomLogger, dbConn *sql.DB, masker model.Masker, policy *model.MaskingPolicy) Login {
 	return &loginStore{
-		dbConn:        dbConn,
-		encryptionKey: encryptionKey,
+		logger: logger,
+		dbConn: dbConn,
+		masker: masker,
+		policy: policy,
 	}
 }
 
-func (l loginStore) Get(filter *model.Filter) ([]model.Response, error) {
+func (l loginStore) Get(ctx context.Context, filter *model.Filter) ([]model.Response, error) {
 	var userLoginList []model.Response
 
 	offset := 1
-	getQuery := fmt.Sprintf("SELECT user_id, device_type, masked_ip, masked_device_id, locale, app_version, create_date FROM user_logins ORDER BY create_date DESC LIMIT %v OFFSET %v;", filter.Limit, filter.Page*offset)
 
+	// Search by equality on the blind indexes as encrypted values are randomized, or on the masked values when they are
+	// equal for equal values.
+	var conditions []string
+	var args []interface{}
+	searches := []struct {
+		field       string
+		value       string
+		indexColumn string
+		maskColumn  string
+	}{
+		{model.FieldIP, filter.IP, "ip_index", "masked_ip"},
+		{model.FieldDeviceID, filter.DeviceID, "device_id_index", "masked_device_id"},
+	}
+
+	for _, search := range searches {
+		if search.value == "" {
+			continue
+		}
+
+		term, indexed, err := l.policy.SearchTerm(ctx, l.masker, search.field, search.value)
+		if err != nil {
+			return nil, err
+		}
+
+		column := search.maskColumn
+		if indexed {
+			column = search.indexColumn
+		}
+
+		args = append(args, term)
+		conditions = append(conditions, fmt.Sprintf("%v = $%d", column, len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	getQuery := fmt.Sprintf("SELECT id, user_id, device_type, masked_ip, masked_device_id, locale, app_version, create_date FROM user_logins %v ORDER BY create_date DESC LIMIT %v OFFSET %v;", where, filter.Limit, filter.Page*offset)
+
+	// Duplicates are grouped on the blind indexes, rows without one, written before blind indexes existed or under a
+	// deterministic action, fall back to their masked values.
 	if filter.GroupDuplicates {
-		getQuery = fmt.Sprintf("WITH DuplicateRecords AS (SELECT *, ROW_NUMBER() OVER (PARTITION BY masked_ip, masked_device_id ORDER BY create_date) AS rn FROM user_logins) SELECT user_id, device_type, masked_ip, masked_device_id, locale, app_version, create_date FROM DuplicateRecords WHERE rn > 1 ORDER BY create_date DESC LIMIT %v OFFSET %v;", filter.Limit, filter.Page*offset)
+		getQuery = fmt.Sprintf("WITH DuplicateRecords AS (SELECT *, ROW_NUMBER() OVER (PARTITION BY COALESCE(ip_index, masked_ip), COALESCE(device_id_index, masked_device_id) ORDER BY create_date) AS rn FROM user_logins %v) SELECT id, user_id, device_type, masked_ip, masked_device_id, locale, app_version, create_date FROM DuplicateRecords WHERE rn > 1 ORDER BY create_date DESC LIMIT %v OFFSET %v;", where, filter.Limit, filter.Page*offset)
 	}
 
-	rows, err := l.dbConn.Query(getQuery)
+	rows, err := l.dbConn.QueryContext(ctx, getQuery, args...)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error fetching records: %v", err.Error()))
 	}
@@ -37,7 +85,7 @@ func (l loginStore) Get(filter *model.Filter) ([]model.Response, error) {
 	for rows.Next() {
 		var userLogin model.Response
 
-		err = rows.Scan(&userLogin.UserID, &userLogin.DeviceType, &userLogin.IP, &userLogin.DeviceID, &userLogin.Locale, &userLogin.AppVersion, &userLogin.CreatedDate)
+		err = rows.Scan(&userLogin.LoginId, &userLogin.UserID, &userLogin.DeviceType, &userLogin.IP, &userLogin.DeviceID, &userLogin.Locale, &userLogin.AppVersion, &userLogin.CreatedDate)
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("Error fetching records: %v", err.Error()))
 		}
@@ -45,20 +93,16 @@ func (l loginStore) Get(filter *model.Filter) ([]model.Response, error) {
 		userLoginList = append(userLoginList, userLogin)
 	}
 
+	// A row that cannot be unmasked is returned masked and flagged rather than failing the whole page.
 	if !filter.IsEncrypted {
-		for _, userLogin := range userLoginList {
-			decryptedDeviceID, err := model.Decrypt(*userLogin.DeviceID, l.encryptionKey)
+		for i := range userLoginList {
+			err = userLoginList[i].UnmaskBody(ctx, l.masker, l.policy)
 			if err != nil {
-				return nil, errors.New(fmt.Sprintf("Error fetching records: %v", err.Error()))
-			}
+				userLoginList[i].UnmaskFailed = true
 
-			decryptedIP, err := model.Decrypt(*userLogin.IP, l.encryptionKey)
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("Error fetching records: %v", err.Error()))
+				lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to unmask login created at %v with error : %v", userLoginList[i].CreatedDate, err.Error())}
+				l.logger.Log(&lm)
 			}
-
-			*userLogin.DeviceID = *decryptedDeviceID
-			*userLogin.IP = *decryptedIP
 		}
 	}
 
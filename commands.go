@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/database"
+	"github.com/shivasaicharanruthala/dataops-takehome/etl"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runCommand runs the one-off command with the given name and arguments.
+func runCommand(ctx context.Context, logger *log.CustomLogger, dbConn *sql.DB, processor etl.Processor, remasker etl.Remasker, eraser etl.Eraser, name string, args []string) {
+	switch name {
+	case "replay":
+		replayDeadLetters(ctx, logger, processor, args)
+	case "remask":
+		remaskLogins(ctx, logger, remasker, args)
+	case "vault-delete":
+		deleteVaultTokens(ctx, logger, database.NewVault(logger, dbConn), args)
+	case "erase":
+		eraseUser(ctx, logger, eraser, args)
+	default:
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Unknown command %v, available commands: replay, remask, vault-delete, erase", name)}
+		logger.Log(&lm)
+	}
+}
+
+// replayDeadLetters re-feeds the pending records of the dead letter through the pipeline, usually after a fix for
+// the reason they failed has shipped.
+func replayDeadLetters(ctx context.Context, logger *log.CustomLogger, processor etl.Processor, args []string) {
+	defaultBatchSize, _ := strconv.Atoi(os.Getenv("BATCH_SIZE"))
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	batchSize := flags.Int("batch-size", defaultBatchSize, "number of dead letters replayed per batch")
+	_ = flags.Parse(args)
+
+	if *batchSize <= 0 {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Invalid replay batch size %v", *batchSize)}
+		logger.Log(&lm)
+
+		return
+	}
+
+	replayed, failed, err := processor.Replay(ctx, *batchSize)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Replaying dead letters failed after %d replayed and %d failed with error %v", replayed, failed, err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Replayed %d dead letters, %d failed again.", replayed, failed)}
+	logger.Log(&lm)
+}
+
+// remaskLogins rewrites the masked values of user_logins that are not in the current masking format, e.g. the ones
+// masked directly with ENCRYPTION_SECRET before envelope encryption, in bounded transactions so that it can run while
+// the API keeps serving, and then rewraps the data keys still wrapped by a retired master key.
+func remaskLogins(ctx context.Context, logger *log.CustomLogger, remasker etl.Remasker, args []string) {
+	flags := flag.NewFlagSet("remask", flag.ExitOnError)
+	batchSize := flags.Int("batch-size", 500, "number of rows remasked per transaction")
+	pause := flags.Duration("pause", 100*time.Millisecond, "pause between two transactions")
+	_ = flags.Parse(args)
+
+	if *batchSize <= 0 {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Invalid remask batch size %v", *batchSize)}
+		logger.Log(&lm)
+
+		return
+	}
+
+	remasked, err := remasker.Remask(ctx, *batchSize, *pause)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Remasking failed after %d rows with error %v", remasked, err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Remasked %d rows.", remasked)}
+	logger.Log(&lm)
+}
+
+// deleteVaultTokens deletes the given tokens from the vault, which makes the values they stand for irrecoverable.
+func deleteVaultTokens(ctx context.Context, logger *log.CustomLogger, vault model.Vault, tokens []string) {
+	if len(tokens) == 0 {
+		lm := log.Message{Level: "ERROR", ErrorMessage: "No token to delete given, usage: vault-delete <token>..."}
+		logger.Log(&lm)
+
+		return
+	}
+
+	for _, token := range tokens {
+		err := vault.Delete(ctx, token)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Deleting token %v from the vault failed with error %v", token, err.Error())}
+			logger.Log(&lm)
+
+			return
+		}
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Deleted %d tokens from the vault.", len(tokens))}
+	logger.Log(&lm)
+}
+
+// eraseUser acts on a right-to-be-forgotten request by deleting all the data of a user.
+func eraseUser(ctx context.Context, logger *log.CustomLogger, eraser etl.Eraser, args []string) {
+	var request model.ErasureRequest
+
+	flags := flag.NewFlagSet("erase", flag.ExitOnError)
+	flags.StringVar(&request.UserID, "user-id", "", "user id whose data is erased")
+	flags.StringVar(&request.RequestedBy, "requested-by", "", "who requested the erasure, recorded in the audit table")
+	flags.StringVar(&request.Reason, "reason", "", "reason of the erasure, e.g. the ticket of the request")
+	_ = flags.Parse(args)
+
+	erasure, err := eraser.Erase(ctx, &request)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Erasing user failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Recorded erasure %d, deleted %d logins, %d dead letters and %d quarantined messages.",
+		erasure.Id, erasure.LoginsDeleted, erasure.DeadLettersDeleted, erasure.QuarantinedDeleted)}
+	logger.Log(&lm)
+}
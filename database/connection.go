@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"github.com/shivasaicharanruthala/dataops-takehome/log"
 	"os"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type dbConn struct {
@@ -20,18 +23,10 @@ func New(logger *log.CustomLogger) SQLDatabase {
 
 // Open initializes and opens a connection to the database using environment variables for configuration.
 func (dbo *dbConn) Open() (*sql.DB, error) {
-	dbUser := os.Getenv("DB_USER")
-	dbPass := os.Getenv("DB_PASS")
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbName := os.Getenv("DB_NAME")
 	dbDriver := os.Getenv("DRIVER_NAME")
 
-	// Create the connection string using the retrieved environment variables.
-	connectionStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", dbUser, dbPass, dbHost, dbPort, dbName)
-
 	// Initialize DB connection
-	db, err := sql.Open(dbDriver, connectionStr)
+	db, err := sql.Open(dbDriver, connectionString())
 	if err != nil {
 		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Database initilization failed with error %v", err.Error())}
 		dbo.logger.Log(&lm)
@@ -41,3 +36,50 @@ func (dbo *dbConn) Open() (*sql.DB, error) {
 
 	return db, nil
 }
+
+// Listen listens to the notifications of the channel on a connection of its own, in the background. onNotify is
+// called with the payload of every notification, and with an empty payload once the connection is reestablished as
+// notifications may have been missed meanwhile.
+func (dbo *dbConn) Listen(channel string, onNotify func(payload string)) error {
+	listener := pq.NewListener(connectionString(), 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Listening to %v failed with error %v", channel, err.Error())}
+			dbo.logger.Log(&lm)
+		}
+	})
+
+	err := listener.Listen(channel)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Listening to %v failed with error %v", channel, err.Error())}
+		dbo.logger.Log(&lm)
+
+		_ = listener.Close()
+
+		return err
+	}
+
+	go func() {
+		// A nil notification is sent once the connection is reestablished.
+		for notification := range listener.Notify {
+			if notification == nil {
+				onNotify("")
+				continue
+			}
+
+			onNotify(notification.Extra)
+		}
+	}()
+
+	return nil
+}
+
+// connectionString returns the connection string of the database built from the environment variables.
+func connectionString() string {
+	dbUser := os.Getenv("DB_USER")
+	dbPass := os.Getenv("DB_PASS")
+	dbHost := os.Getenv("DB_HOST")
+	dbPort := os.Getenv("DB_PORT")
+	dbName := os.Getenv("DB_NAME")
+
+	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", dbUser, dbPass, dbHost, dbPort, dbName)
+}
@@ -4,4 +4,5 @@ import "database/sql"
 
 type SQLDatabase interface {
 	Open() (*sql.DB, error)
+	Listen(channel string, onNotify func(payload string)) error
 }
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"time"
+)
+
+// DataKeyShreddedChannel is the channel on which the ids of the shredded data keys are notified.
+const DataKeyShreddedChannel = "data_key_shredded"
+
+type dataKeyStore struct {
+	logger *log.CustomLogger
+	dbConn *sql.DB
+}
+
+// NewDataKeyStore creates a new instance of the model.DataKeyStore backed by the encryption_data_keys table.
+func NewDataKeyStore(logger *log.CustomLogger, dbConn *sql.DB) model.DataKeyStore {
+	return &dataKeyStore{
+		logger: logger,
+		dbConn: dbConn,
+	}
+}
+
+// Put stores a wrapped data key.
+func (s *dataKeyStore) Put(ctx context.Context, key *model.DataKey) error {
+	stmt := "INSERT INTO encryption_data_keys (id, master_key_id, wrapped_key, created_at) VALUES ($1, $2, $3, $4)"
+
+	_, err := s.dbConn.ExecContext(ctx, stmt, key.ID, key.MasterKeyID, key.Wrapped, key.CreatedAt)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to store data key with error : %v", err.Error())}
+		s.logger.Log(&lm)
+
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the wrapped data key with the given id.
+func (s *dataKeyStore) Get(ctx context.Context, id string) (*model.DataKey, error) {
+	key := model.DataKey{ID: id}
+
+	var shreddedAt sql.NullTime
+	err := s.dbConn.QueryRowContext(ctx, "SELECT master_key_id, wrapped_key, created_at, shredded_at FROM encryption_data_keys WHERE id = $1", id).
+		Scan(&key.MasterKeyID, &key.Wrapped, &key.CreatedAt, &shreddedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %v", model.ErrDataKeyNotFound, id)
+	}
+
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to fetch data key %v with error : %v", id, err.Error())}
+		s.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	if shreddedAt.Valid {
+		return nil, fmt.Errorf("%w: %v", model.ErrDataKeyShredded, id)
+	}
+
+	return &key, nil
+}
+
+// Retired returns the data keys wrapped by another master key than the active one, tombstones having no master key.
+func (s *dataKeyStore) Retired(ctx context.Context, activeMasterKeyID string, afterID string, limit int) ([]*model.DataKey, error) {
+	stmt := "SELECT id, master_key_id, wrapped_key, created_at FROM encryption_data_keys WHERE master_key_id <> $1 AND id > $2 AND shredded_at IS NULL AND wrapped_key IS NOT NULL ORDER BY id LIMIT $3"
+
+	rows, err := s.dbConn.QueryContext(ctx, stmt, activeMasterKeyID, afterID, limit)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to fetch retired data keys with error : %v", err.Error())}
+		s.logger.Log(&lm)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*model.DataKey
+	for rows.Next() {
+		var key model.DataKey
+
+		err = rows.Scan(&key.ID, &key.MasterKeyID, &key.Wrapped, &key.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Rewrap updates the master key id and the wrapped key of the data key, as long as it was not shredded meanwhile.
+func (s *dataKeyStore) Rewrap(ctx context.Context, key *model.DataKey, previousMasterKeyID string) error {
+	stmt := "UPDATE encryption_data_keys SET master_key_id = $1, wrapped_key = $2 WHERE id = $3 AND master_key_id = $4 AND shredded_at IS NULL"
+
+	_, err := s.dbConn.ExecContext(ctx, stmt, key.MasterKeyID, key.Wrapped, key.ID, previousMasterKeyID)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to rewrap data key %v with error : %v", key.ID, err.Error())}
+		s.logger.Log(&lm)
+
+		return err
+	}
+
+	return nil
+}
+
+// Shred replaces the data key with the given id by a tombstone, a row without wrapped key, and notifies its id on
+// the DataKeyShreddedChannel.
+func (s *dataKeyStore) Shred(ctx context.Context, id string) error {
+	stmt := "INSERT INTO encryption_data_keys (id, master_key_id, wrapped_key, created_at, shredded_at) VALUES ($1, '', NULL, $2, $2) " +
+		"ON CONFLICT (id) DO UPDATE SET wrapped_key = NULL, shredded_at = EXCLUDED.shredded_at"
+
+	_, err := s.dbConn.ExecContext(ctx, stmt, id, time.Now().UTC())
+	if err == nil {
+		_, err = s.dbConn.ExecContext(ctx, "SELECT pg_notify($1, $2)", DataKeyShreddedChannel, id)
+	}
+
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to shred data key %v with error : %v", id, err.Error())}
+		s.logger.Log(&lm)
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+)
+
+type vault struct {
+	logger *log.CustomLogger
+	dbConn *sql.DB
+}
+
+// NewVault creates a new instance of the model.Vault backed by the pii_vault table.
+func NewVault(logger *log.CustomLogger, dbConn *sql.DB) model.Vault {
+	return &vault{
+		logger: logger,
+		dbConn: dbConn,
+	}
+}
+
+// Store inserts the entry, or returns the token already stored for the same value of the field.
+func (v *vault) Store(ctx context.Context, entry *model.VaultEntry) (string, error) {
+	stmt := "INSERT INTO pii_vault (token, field, value_index, masked_value, created_at) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT (field, value_index) DO NOTHING RETURNING token"
+
+	var token string
+	err := v.dbConn.QueryRowContext(ctx, stmt, entry.Token, entry.Field, entry.ValueIndex, entry.MaskedValue, entry.CreatedAt).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = v.dbConn.QueryRowContext(ctx, "SELECT token FROM pii_vault WHERE field = $1 AND value_index = $2", entry.Field, entry.ValueIndex).Scan(&token)
+	}
+
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to store value of %v in the vault with error : %v", entry.Field, err.Error())}
+		v.logger.Log(&lm)
+
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Get returns the entry of the token.
+func (v *vault) Get(ctx context.Context, token string) (*model.VaultEntry, error) {
+	entry := model.VaultEntry{Token: token}
+
+	err := v.dbConn.QueryRowContext(ctx, "SELECT field, value_index, masked_value, created_at FROM pii_vault WHERE token = $1", token).
+		Scan(&entry.Field, &entry.ValueIndex, &entry.MaskedValue, &entry.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %v", model.ErrTokenNotFound, token)
+	}
+
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to fetch token %v from the vault with error : %v", token, err.Error())}
+		v.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// tokenColumns are the masked value and blind index columns of user_logins of the fields that have a blind index.
+var tokenColumns = map[string][2]string{
+	model.FieldIP:       {"masked_ip", "ip_index"},
+	model.FieldDeviceID: {"masked_device_id", "device_id_index"},
+}
+
+// Delete deletes the entry of the token and, in the same transaction, clears the blind index of the logins holding
+// the token, so that their value can no longer be matched either. Deleting a token that is not in the vault is not an
+// error.
+func (v *vault) Delete(ctx context.Context, token string) error {
+	err := v.delete(ctx, token)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to delete token %v from the vault with error : %v", token, err.Error())}
+		v.logger.Log(&lm)
+
+		return err
+	}
+
+	return nil
+}
+
+func (v *vault) delete(ctx context.Context, token string) error {
+	tx, err := v.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var field string
+	err = tx.QueryRowContext(ctx, "DELETE FROM pii_vault WHERE token = $1 RETURNING field", token).Scan(&field)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	columns, ok := tokenColumns[field]
+	if ok {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE user_logins SET %v = NULL WHERE %v = $1 AND %v IS NOT NULL", columns[1], columns[0], columns[1]), token)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
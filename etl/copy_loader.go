@@ -0,0 +1,125 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// copyLoader bulk loads batches through the postgres COPY protocol, rows are inserted one by one the same way as
+// the loader does.
+type copyLoader struct {
+	*loader
+}
+
+// NewCopyLoader creates a new instance of the Loader that bulk loads batches using COPY FROM STDIN.
+func NewCopyLoader(logger *log.CustomLogger, dbConn *sql.DB) Loader {
+	return &copyLoader{
+		loader: &loader{
+			logger: logger,
+			dbConn: dbConn,
+		},
+	}
+}
+
+// BatchInsert copies a batch of responses into the PostgreSQL database within a single transaction. Unlike the
+// multi-row insert it is not limited by the number of bind parameters of a statement. Responses whose message was
+// already loaded are skipped, as are the responses sent before the erasure of their user.
+func (l *copyLoader) BatchInsert(ctx context.Context, responses []*model.Response) error {
+	tx, err := l.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to begin copy transaction with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	defer tx.Rollback()
+
+	batchSize := len(responses)
+	responses, err = l.dropErased(ctx, tx, responses)
+	if err != nil {
+		return err
+	}
+
+	if len(responses) == 0 {
+		return tx.Commit()
+	}
+
+	// Copy the batch into a staging table first as COPY cannot skip the messages that were already loaded.
+	columns := strings.Join(loginColumns, ", ")
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE user_logins_staging ON COMMIT DROP AS SELECT %s FROM user_logins WITH NO DATA", columns))
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to create staging table with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("user_logins_staging", loginColumns...))
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to prepare copy with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	loadedAt := time.Now().UTC()
+	for _, response := range responses {
+		_, err = stmt.ExecContext(ctx, loginValues(response, loadedAt)...)
+		if err != nil {
+			_ = stmt.Close()
+
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to copy row with error : %v", err.Error())}
+			l.logger.Log(&lm)
+
+			return err
+		}
+	}
+
+	// Flush the buffered rows, errors raised by the server for the copied data are returned here.
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		_ = stmt.Close()
+
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to execute batch copy with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to close batch copy with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO user_logins (%s) SELECT %s FROM user_logins_staging ON CONFLICT (message_id) DO NOTHING", columns, columns))
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to move staged batch with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to commit batch copy with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	inserted, _ := result.RowsAffected()
+	l.logInserted(inserted, batchSize, batchSize-len(responses))
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+
+	"github.com/lib/pq"
+)
+
+type deadLetter struct {
+	logger *log.CustomLogger
+	dbConn *sql.DB
+}
+
+// NewDeadLetter creates a new instance of the DeadLetter sink backed by the user_logins_dead_letter table.
+func NewDeadLetter(logger *log.CustomLogger, dbConn *sql.DB) DeadLetter {
+	return &deadLetter{
+		logger: logger,
+		dbConn: dbConn,
+	}
+}
+
+// Store persists the dead letters in a single transaction. A message that is already dead-lettered has its stage
+// and error updated, its attempt count incremented and becomes pending for replay again.
+func (d *deadLetter) Store(ctx context.Context, letters []*model.DeadLetter) error {
+	tx, err := d.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to begin dead letter transaction with error : %v", err.Error())}
+		d.logger.Log(&lm)
+
+		return err
+	}
+
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO user_logins_dead_letter (message_id, request_id, raw_body, sent_timestamp, stage, error_message, attempts, first_failed_at, last_failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (message_id) DO UPDATE SET stage = EXCLUDED.stage, error_message = EXCLUDED.error_message,
+			attempts = user_logins_dead_letter.attempts + 1, last_failed_at = EXCLUDED.last_failed_at, replayed_at = NULL`
+
+	for _, letter := range letters {
+		_, err = tx.ExecContext(ctx, stmt, letter.MessageId, letter.RequestId, letter.RawBody, letter.SentAt, letter.Stage, letter.ErrorMessage, letter.Attempts, letter.FirstFailedAt, letter.LastFailedAt)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to store dead letter with error : %v", err.Error())}
+			d.logger.Log(&lm)
+
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to commit dead letters with error : %v", err.Error())}
+		d.logger.Log(&lm)
+
+		return err
+	}
+
+	lm := log.Message{Level: "WARN", Msg: fmt.Sprintf("Stored %d records in dead letter.", len(letters))}
+	d.logger.Log(&lm)
+
+	return nil
+}
+
+// Pending returns up to limit dead letters that have not been replayed yet, with an id greater than afterId.
+func (d *deadLetter) Pending(ctx context.Context, afterId int64, limit int) ([]*model.DeadLetter, error) {
+	stmt := `SELECT id, message_id, request_id, raw_body, sent_timestamp, stage, error_message, attempts, first_failed_at, last_failed_at
+		FROM user_logins_dead_letter WHERE replayed_at IS NULL AND id > $1 ORDER BY id LIMIT $2`
+
+	rows, err := d.dbConn.QueryContext(ctx, stmt, afterId, limit)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to fetch dead letters with error : %v", err.Error())}
+		d.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var letters []*model.DeadLetter
+	for rows.Next() {
+		var letter model.DeadLetter
+
+		err = rows.Scan(&letter.Id, &letter.MessageId, &letter.RequestId, &letter.RawBody, &letter.SentAt, &letter.Stage, &letter.ErrorMessage, &letter.Attempts, &letter.FirstFailedAt, &letter.LastFailedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		letters = append(letters, &letter)
+	}
+
+	return letters, rows.Err()
+}
+
+// MarkReplayed flags the dead letters of the given messages as successfully replayed.
+func (d *deadLetter) MarkReplayed(ctx context.Context, messageIds []string) error {
+	if len(messageIds) == 0 {
+		return nil
+	}
+
+	_, err := d.dbConn.ExecContext(ctx, "UPDATE user_logins_dead_letter SET replayed_at = NOW() AT TIME ZONE 'UTC' WHERE message_id = ANY($1)", pq.Array(messageIds))
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to mark dead letters as replayed with error : %v", err.Error())}
+		d.logger.Log(&lm)
+
+		return err
+	}
+
+	return nil
+}
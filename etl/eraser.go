@@ -0,0 +1,180 @@
+package etl
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type eraser struct {
+	logger *log.CustomLogger
+	dbConn *sql.DB
+	masker model.Masker
+	policy *model.MaskingPolicy
+}
+
+// NewEraser creates a new instance of the Eraser acting on right-to-be-forgotten requests. Users are identified by
+// the blind index of their user id computed by the masker. Users are erased by deleting their data key when the
+// masking policy scopes keys to users.
+func NewEraser(logger *log.CustomLogger, dbConn *sql.DB, masker model.Masker, policy *model.MaskingPolicy) Eraser {
+	return &eraser{
+		logger: logger,
+		dbConn: dbConn,
+		masker: masker,
+		policy: policy,
+	}
+}
+
+// Erase deletes, in a single transaction, the logins of the user along with the dead-lettered and quarantined
+// messages carrying their user id and the vault entries of the tokens held by their logins only, and records the
+// erasure in user_logins_erasures. Logins loaded before user ids had a blind index are matched on their plaintext user
+// id. The user is locked for the transaction, so that loads of their messages either commit before it or skip them.
+// In shred mode the data key of the user is shredded first and only the logins holding an IP or device id not masked
+// with it are deleted, the others are kept unreadable with their user id and blind indexes cleared.
+func (e *eraser) Erase(ctx context.Context, request *model.ErasureRequest) (*model.Erasure, error) {
+	if request.UserID == "" || request.RequestedBy == "" {
+		return nil, errors.New("user_id and requested_by are required")
+	}
+
+	erasure := model.Erasure{
+		UserIDIndex: e.masker.BlindIndex(model.FieldUserID, request.UserID),
+		RequestedBy: request.RequestedBy,
+		Reason:      request.Reason,
+		RequestedAt: time.Now().UTC(),
+		Mode:        model.ErasureModeDelete,
+	}
+
+	userCondition := "(user_id_index = $1 OR (user_id_index IS NULL AND user_id = $2))"
+	loginsStmt := "DELETE FROM user_logins WHERE " + userCondition
+
+	// Tokens held by logins of the user and of no other user, the vault holding a single token per value.
+	loginTokens := "unnest(ARRAY[user_id, device_type, masked_ip, masked_device_id, locale, app_version])"
+	vaultStmt := fmt.Sprintf("DELETE FROM pii_vault WHERE token IN (SELECT token FROM user_logins, %v AS held(token) WHERE %v AND starts_with(token, $3)) "+
+		"AND token NOT IN (SELECT token FROM user_logins, %v AS held(token) WHERE NOT COALESCE(%v, false) AND token IS NOT NULL)", loginTokens, userCondition, loginTokens, userCondition)
+	vaultArgs := []interface{}{erasure.UserIDIndex, request.UserID, model.TokenPrefix}
+	loginsArgs := []interface{}{erasure.UserIDIndex, request.UserID}
+
+	if e.policy.UserKeys() {
+		erasure.Mode = model.ErasureModeShred
+
+		// The key is shredded before anything else, a failed erasure leaves the values unreadable and can be retried.
+		err := e.masker.ShredUser(ctx, erasure.UserIDIndex)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to delete user data key with error : %v", err.Error())}
+			e.logger.Log(&lm)
+
+			return nil, err
+		}
+
+		shredded := model.MaskingVersionEnvelope + ":" + model.UserDataKeyID(erasure.UserIDIndex) + ":%"
+		loginsStmt += " AND NOT ((masked_ip IS NULL OR masked_ip LIKE $3) AND (masked_device_id IS NULL OR masked_device_id LIKE $3))"
+		loginsArgs = append(loginsArgs, shredded)
+	}
+
+	pattern, err := rawUserIDPattern(request.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := e.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", erasureLockClass, erasure.UserIDIndex)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to lock user with error : %v", err.Error())}
+		e.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	// The erasure is recorded first, so that messages of the user flushed once it is committed are not loaded.
+	err = tx.QueryRowContext(ctx, "INSERT INTO user_logins_erasures (user_id_index, requested_by, reason, requested_at, mode) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		erasure.UserIDIndex, erasure.RequestedBy, erasure.Reason, erasure.RequestedAt, erasure.Mode).Scan(&erasure.Id)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to record erasure with error : %v", err.Error())}
+		e.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	deletes := []struct {
+		count *int64
+		stmt  string
+		args  []interface{}
+	}{
+		{&erasure.VaultEntriesDeleted, vaultStmt, vaultArgs},
+		{&erasure.LoginsDeleted, loginsStmt, loginsArgs},
+		{&erasure.DeadLettersDeleted, "DELETE FROM user_logins_dead_letter WHERE raw_body ~ $1", []interface{}{pattern}},
+		{&erasure.QuarantinedDeleted, "DELETE FROM user_logins_quarantine WHERE raw_payload ~ $1", []interface{}{pattern}},
+	}
+
+	for _, d := range deletes {
+		result, err := tx.ExecContext(ctx, d.stmt, d.args...)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to erase user data with error : %v", err.Error())}
+			e.logger.Log(&lm)
+
+			return nil, err
+		}
+
+		*d.count, _ = result.RowsAffected()
+	}
+
+	if erasure.Mode == model.ErasureModeShred {
+		// The user id and the blind indexes of the kept logins would still link them to the user, or to other logins.
+		result, err := tx.ExecContext(ctx, "UPDATE user_logins SET user_id = NULL, user_id_index = NULL, ip_index = NULL, device_id_index = NULL WHERE "+userCondition,
+			erasure.UserIDIndex, request.UserID)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to clear shredded logins with error : %v", err.Error())}
+			e.logger.Log(&lm)
+
+			return nil, err
+		}
+
+		erasure.LoginsShredded, _ = result.RowsAffected()
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE user_logins_erasures SET logins_deleted = $1, dead_letters_deleted = $2, quarantined_deleted = $3, logins_shredded = $4, vault_entries_deleted = $5 WHERE id = $6",
+		erasure.LoginsDeleted, erasure.DeadLettersDeleted, erasure.QuarantinedDeleted, erasure.LoginsShredded, erasure.VaultEntriesDeleted, erasure.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Erasure %d requested by %v in %v mode deleted %d logins, %d dead letters, %d quarantined messages and %d vault entries and shredded %d logins.",
+		erasure.Id, erasure.RequestedBy, erasure.Mode, erasure.LoginsDeleted, erasure.DeadLettersDeleted, erasure.QuarantinedDeleted, erasure.VaultEntriesDeleted, erasure.LoginsShredded)}
+	e.logger.Log(&lm)
+
+	return &erasure, nil
+}
+
+// rawUserIDPattern returns a regular expression matching the user_id member of a raw JSON message body.
+func rawUserIDPattern(userID string) (string, error) {
+	var encoded bytes.Buffer
+
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(userID)
+	if err != nil {
+		return "", err
+	}
+
+	return `"user_id"\s*:\s*` + regexp.QuoteMeta(strings.TrimSpace(encoded.String())), nil
+}
@@ -1,99 +1,718 @@
 package etl
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/shivasaicharanruthala/dataops-takehome/log"
 	"github.com/shivasaicharanruthala/dataops-takehome/model"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqsAPIVersion is the version of the SQS query API the extractor speaks.
+const sqsAPIVersion = "2012-11-05"
+
+// Wire protocols of SQS: the XML query protocol, form-encoded requests answered in XML, and the JSON 1.0 protocol of
+// newer endpoints and SDKs.
+const (
+	SQSProtocolQuery = "query"
+	SQSProtocolJSON  = "json"
+)
+
+const (
+	// fifoQueueSuffix ends the name of the FIFO queues.
+	fifoQueueSuffix = ".fifo"
+	// receiveAttempts is the number of times a ReceiveMessage call to a FIFO queue is sent with the same
+	// ReceiveRequestAttemptId when SQS cannot be reached or fails, so that the messages of a lost response are received
+	// again instead of staying hidden, and holding back their message group, until their visibility timeout expires.
+	receiveAttempts = 3
+	// sqsJSONContentType is the content type of the requests and responses of the JSON protocol.
+	sqsJSONContentType = "application/x-amz-json-1.0"
+	// sqsJSONTargetPrefix prefixes the action in the X-Amz-Target header of the JSON protocol.
+	sqsJSONTargetPrefix = "AmazonSQS."
 )
 
 type extractor struct {
-	httpClient    *http.Client
-	logger        *log.CustomLogger
-	sqsEndpoint   string
-	encryptionKey string
+	httpClient          *http.Client
+	logger              *log.CustomLogger
+	quarantine          Quarantine
+	deadLetter          DeadLetter
+	masker              model.Masker
+	policy              *model.MaskingPolicy
+	sqsEndpoint         string
+	protocol            string
+	fifo                bool
+	signer              *sigV4Signer
+	maxNumberOfMessages int
+	waitTimeSeconds     int
+	visibilityTimeout   int
+	storeCtx            context.Context
 }
 
-// NewExtractor creates a new instance of the Extractor and initializes it with the SQS endpoint from environment variables.
-func NewExtractor(logger *log.CustomLogger, sqsEndpoint string, encryptionKey string) Extract {
-	return &extractor{
-		httpClient:    new(http.Client),
-		logger:        logger,
-		sqsEndpoint:   sqsEndpoint,
-		encryptionKey: encryptionKey,
+// ExtractorConfig holds the settings used by the extractor to receive messages from SQS.
+type ExtractorConfig struct {
+	SQSEndpoint string
+	// Protocol is the wire protocol requests are sent with, SQSProtocolQuery by default. Responses are decoded
+	// according to their content type whatever the protocol.
+	Protocol string
+	// MaxNumberOfMessages is the number of messages requested per ReceiveMessage call, between 1 and 10.
+	MaxNumberOfMessages int
+	// WaitTimeSeconds enables long polling when greater than zero, between 0 and 20.
+	WaitTimeSeconds int
+	// VisibilityTimeout is the visibility timeout, in seconds, of the received messages, that of the queue when zero.
+	VisibilityTimeout int
+	// Region and Credentials sign the requests with AWS Signature Version 4, requests are sent unsigned, as
+	// localstack accepts them, when no access key id is set.
+	Region      string
+	Credentials AWSCredentials
+	// StoreContext bounds the calls quarantining or dead-lettering a message and acknowledging it, e.g. the context of
+	// the flushes cancelled on the shutdown deadline, each of them taking at most storeTimeout. They are only bounded
+	// by storeTimeout when it is nil.
+	StoreContext context.Context
+}
+
+// NewExtractor creates a new instance of the Extractor and initializes it with the given configuration. Corrupted and
+// unparsable messages are handed to the quarantine store and messages failing to be validated or masked to the dead
+// letter sink, PII fields are masked according to the policy, with a data key of the masker per received batch. An
+// error is returned when the credentials are set but incomplete or the protocol is unknown. Queues whose name ends with
+// .fifo are read as FIFO queues.
+func NewExtractor(logger *log.CustomLogger, quarantine Quarantine, deadLetter DeadLetter, masker model.Masker, policy *model.MaskingPolicy, config ExtractorConfig) (Extract, error) {
+	maxNumberOfMessages := config.MaxNumberOfMessages
+	if maxNumberOfMessages < 1 || maxNumberOfMessages > model.MaxBatchEntries {
+		maxNumberOfMessages = model.MaxBatchEntries
 	}
+
+	waitTimeSeconds := config.WaitTimeSeconds
+	if waitTimeSeconds < 0 {
+		waitTimeSeconds = 0
+	} else if waitTimeSeconds > model.MaxWaitTimeSeconds {
+		waitTimeSeconds = model.MaxWaitTimeSeconds
+	}
+
+	visibilityTimeout := config.VisibilityTimeout
+	if visibilityTimeout < 0 {
+		visibilityTimeout = 0
+	} else if visibilityTimeout > model.MaxVisibilityTimeout {
+		visibilityTimeout = model.MaxVisibilityTimeout
+	}
+
+	storeCtx := config.StoreContext
+	if storeCtx == nil {
+		storeCtx = context.Background()
+	}
+
+	protocol := config.Protocol
+	if protocol == "" {
+		protocol = SQSProtocolQuery
+	}
+
+	if protocol != SQSProtocolQuery && protocol != SQSProtocolJSON {
+		return nil, errors.New(fmt.Sprintf("unknown sqs protocol %q", config.Protocol))
+	}
+
+	endpoint, err := url.Parse(config.SQSEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *sigV4Signer
+	if config.Credentials.AccessKeyID != "" {
+		var err error
+		signer, err = newSigV4Signer(config.Credentials, config.Region, sqsSigningName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &extractor{
+		httpClient:          new(http.Client),
+		logger:              logger,
+		quarantine:          quarantine,
+		deadLetter:          deadLetter,
+		masker:              masker,
+		policy:              policy,
+		sqsEndpoint:         config.SQSEndpoint,
+		protocol:            protocol,
+		fifo:                strings.HasSuffix(endpoint.Path, fifoQueueSuffix),
+		signer:              signer,
+		maxNumberOfMessages: maxNumberOfMessages,
+		waitTimeSeconds:     waitTimeSeconds,
+		visibilityTimeout:   visibilityTimeout,
+		storeCtx:            storeCtx,
+	}, nil
 }
 
-// FetchDataFromSQS fetches data from the SQS endpoint, processes the response, and returns a model.Response.
-func (ex extractor) FetchDataFromSQS() (*model.Response, error) {
-	// Create a new GET request to the SQS endpoint.
-	req, err := http.NewRequest("GET", ex.sqsEndpoint, nil)
+// FetchDataFromSQS receives up to MaxNumberOfMessages messages from SQS using long polling, processes them and returns
+// a model.Response for each message. Messages that cannot be processed are logged and skipped, corrupted and unparsable
+// ones are quarantined and the ones failing to be validated or masked are dead-lettered. Calls to a FIFO queue carry a
+// ReceiveRequestAttemptId, they are retried with it when SQS cannot be reached and it is set on the responses.
+func (ex extractor) FetchDataFromSQS(ctx context.Context) ([]*model.Response, error) {
+	params := url.Values{}
+	params.Set("MaxNumberOfMessages", strconv.Itoa(ex.maxNumberOfMessages))
+	params.Set("WaitTimeSeconds", strconv.Itoa(ex.waitTimeSeconds))
+
+	// All the system and custom attributes are requested, the SentTimestamp being the time the login happened.
+	params.Set("AttributeName.1", "All")
+	params.Set("MessageAttributeName.1", "All")
+
+	input := map[string]interface{}{
+		"MaxNumberOfMessages":   ex.maxNumberOfMessages,
+		"WaitTimeSeconds":       ex.waitTimeSeconds,
+		"AttributeNames":        []string{"All"},
+		"MessageAttributeNames": []string{"All"},
+	}
+
+	if ex.visibilityTimeout > 0 {
+		params.Set("VisibilityTimeout", strconv.Itoa(ex.visibilityTimeout))
+		input["VisibilityTimeout"] = ex.visibilityTimeout
+	}
+
+	var attemptId string
+	attempts := 1
+	if ex.fifo {
+		var err error
+		attemptId, err = newReceiveRequestAttemptId()
+		if err != nil {
+			return nil, err
+		}
+
+		params.Set("ReceiveRequestAttemptId", attemptId)
+		input["ReceiveRequestAttemptId"] = attemptId
+		attempts = receiveAttempts
+	}
+
+	var response *sqsResponse
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		response, err = ex.call(ctx, "ReceiveMessage", params, input)
+		if err == nil || !isRetryableSQSError(ctx, err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the response into the ReceiveMessageResponse struct, the JSON protocol only returns its result.
+	var sqsMessageResponse model.ReceiveMessageResponse
+	err = response.decode(&sqsMessageResponse, &sqsMessageResponse.ReceiveMessageResult)
 	if err != nil {
-		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error creating request to sqs enpoint: %v", err.Error())}
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error unmarshalling response from sqs enpoint : %v", err.Error())}
 		ex.logger.Log(&lm)
 
 		return nil, err
 	}
 
-	// Send the request and receive the response.
-	resp, err := ex.httpClient.Do(req)
+	if sqsMessageResponse.ResponseMetadata.RequestId == nil {
+		sqsMessageResponse.ResponseMetadata.RequestId = response.requestId
+	}
+
+	messages := sqsMessageResponse.ReceiveMessageResult.Messages
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	// The messages of the batch are masked with a data key of their own, when none can be generated they are left on
+	// the queue to be redelivered.
+	masker, err := ex.masker.WithDataKey(ctx)
 	if err != nil {
-		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error sending request to sqs enpoint: %v", err.Error())}
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error generating data key for %d messages : %v", len(messages), err.Error())}
 		ex.logger.Log(&lm)
 
 		return nil, err
 	}
 
-	defer resp.Body.Close()
+	responses := make([]*model.Response, 0, len(messages))
+	for _, message := range messages {
+		res, err := ex.process(ctx, masker, sqsMessageResponse.ResponseMetadata.RequestId, message)
+		if err != nil {
+			continue
+		}
 
-	// Read the response body.
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error reading response from sqs enpoint : %v", err.Error())}
+		res.ReceiveRequestAttemptId = attemptId
+
+		responses = append(responses, res)
+	}
+
+	return responses, nil
+}
+
+// process verifies the integrity of a single SQS message and transforms it into a masked model.Response. Messages whose
+// body does not match the MD5OfBody sent by SQS or is not valid JSON are quarantined and the ones failing to be
+// validated or masked are dead-lettered, but for the messages of users whose data key was shredded, which are
+// acknowledged, and the ones whose masking failed for another reason than their values, see model.ErrInvalidValue,
+// which are left on the queue.
+func (ex extractor) process(ctx context.Context, masker model.Masker, requestId *string, message *model.Message) (*model.Response, error) {
+	// Verify the integrity of the body before trusting its content.
+	if !message.VerifyMD5() {
+		err := errors.New(fmt.Sprintf("MD5 of body %v does not match MD5OfBody %v", message.BodyMD5(), message.MD5OfBody))
+
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error verifying message from sqs enpoint : %v", err.Error())}
 		ex.logger.Log(&lm)
 
+		ex.quarantineMessage(model.NewQuarantinedMessage(requestId, message, model.QuarantineReasonMD5Mismatch, err.Error()), message)
+
 		return nil, err
 	}
 
-	// Unmarshal the XML response into the ReceiveMessageResponse struct.
-	var sqsMessageResponse model.ReceiveMessageResponse
-	err = xml.Unmarshal(body, &sqsMessageResponse)
-	if err != nil {
-		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error unmarshalling XML response from sqs enpoint : %v", err.Error())}
+	res, err := ex.Transform(ctx, masker, requestId, message)
+	if errors.Is(err, model.ErrDataKeyShredded) {
+		// The user was erased, the message is acknowledged without keeping any of its data.
+		lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Skipped message %v of an erased user.", stringValue(message.MessageId))}
 		ex.logger.Log(&lm)
 
+		_ = ex.DeleteMessageBatch(ctx, []*model.Response{{MessageId: message.MessageId, ReceiptHandle: message.ReceiptHandle}})
+
+		return nil, err
+	}
+
+	if err != nil {
+		var stageErr *model.StageError
+		if !errors.As(err, &stageErr) {
+			return nil, err
+		}
+
+		switch {
+		case stageErr.Stage == model.StageParse:
+			// A body that is not valid JSON is not fixed by a new release, it is kept aside along with corrupted ones.
+			ex.quarantineMessage(model.NewQuarantinedMessage(requestId, message, model.QuarantineReasonInvalidJSON, stageErr.Err.Error()), message)
+		case stageErr.Stage == model.StageMask && !errors.Is(stageErr.Err, model.ErrInvalidValue):
+			// The masking failed for a transient reason, e.g. the KMS or the vault being unreachable or ctx being
+			// cancelled on shutdown, the message is left on the queue to be redelivered.
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Message %v left on the queue for redelivery.", stringValue(message.MessageId))}
+			ex.logger.Log(&lm)
+		default:
+			ex.deadLetterMessage(model.NewDeadLetter(message.MessageId, requestId, message.Body, message.Attributes.Timestamp(model.AttributeSentTimestamp), stageErr.Stage, stageErr.Err), message)
+		}
+
 		return nil, err
 	}
 
-	// Initialize a new Response struct.
+	return res, nil
+}
+
+// Transform parses, validates and masks the body of a single SQS message into a model.Response with the masker bound
+// to the data key of its batch. The returned error is a *model.StageError naming the stage of the pipeline that failed.
+func (ex extractor) Transform(ctx context.Context, masker model.Masker, requestId *string, message *model.Message) (*model.Response, error) {
+	// Unmarshal the JSON body of the SQS message into the Response struct.
 	var res model.Response
-	if sqsMessageResponse.ReceiveMessageResult.Message != nil {
-		// Unmarshal the JSON body of the SQS message into the Response struct.
-		err = json.Unmarshal([]byte(sqsMessageResponse.ReceiveMessageResult.Message.Body), &res)
+	err := json.Unmarshal([]byte(message.Body), &res)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error unmarshalling JSON body from XML response from sqs enpoint : %v", err.Error())}
+		ex.logger.Log(&lm)
+
+		return nil, &model.StageError{Stage: model.StageParse, Err: err}
+	}
+
+	// Set additional data from the SQS message into the Response struct.
+	res.SetData(requestId, message)
+
+	// Validation of fields
+	if !res.Validate() {
+		err = errors.New("one of the required fields message_id, user_id, ip, device_id or device_type is missing")
+
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error validating message %v : %v", stringValue(res.MessageId), err.Error())}
+		ex.logger.Log(&lm)
+
+		return nil, &model.StageError{Stage: model.StageValidate, Err: err}
+	}
+
+	// Mask sensitive data in the Response struct.
+	err = res.MaskBody(ctx, masker, ex.policy)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error masking message %v : %v", stringValue(res.MessageId), err.Error())}
+		ex.logger.Log(&lm)
+
+		return nil, &model.StageError{Stage: model.StageMask, Err: err}
+	}
+
+	return &res, nil
+}
+
+// storeTimeout bounds the calls quarantining or dead-lettering a message and acknowledging it, so that a hung database
+// holds neither the worker nor the shutdown.
+const storeTimeout = 10 * time.Second
+
+// quarantineMessage stores the message in quarantine and deletes it from SQS so that it is not redelivered. When the
+// message cannot be quarantined it is left on the queue.
+func (ex extractor) quarantineMessage(quarantined *model.QuarantinedMessage, message *model.Message) {
+	ctx, cancel := context.WithTimeout(ex.storeCtx, storeTimeout)
+	defer cancel()
+
+	err := ex.quarantine.Store(ctx, quarantined)
+	if err != nil {
+		return
+	}
+
+	_ = ex.DeleteMessageBatch(ctx, []*model.Response{{MessageId: message.MessageId, ReceiptHandle: message.ReceiptHandle}})
+}
+
+// deadLetterMessage stores the message in the dead letter sink and deletes it from SQS so that it is not redelivered.
+// When the message cannot be dead-lettered it is left on the queue.
+func (ex extractor) deadLetterMessage(letter *model.DeadLetter, message *model.Message) {
+	ctx, cancel := context.WithTimeout(ex.storeCtx, storeTimeout)
+	defer cancel()
+
+	err := ex.deadLetter.Store(ctx, []*model.DeadLetter{letter})
+	if err != nil {
+		return
+	}
+
+	_ = ex.DeleteMessageBatch(ctx, []*model.Response{{MessageId: message.MessageId, ReceiptHandle: message.ReceiptHandle}})
+}
+
+// DeleteMessageBatch acknowledges the given responses by deleting their messages from the SQS queue in batches of
+// at most model.MaxBatchEntries. Responses without a receipt handle are skipped. Messages that SQS fails to delete
+// are logged and reported in the returned error, they will be redelivered once their visibility timeout expires.
+func (ex extractor) DeleteMessageBatch(ctx context.Context, responses []*model.Response) error {
+	pending, failed := ex.sendBatch(ctx, "DeleteMessageBatch", "DeleteMessageBatchRequestEntry", responses, nil,
+		func(response *sqsResponse) ([]model.BatchResultErrorEntry, error) {
+			var deleteResponse model.DeleteMessageBatchResponse
+			err := response.decode(&deleteResponse, &deleteResponse.DeleteMessageBatchResult)
+
+			return deleteResponse.DeleteMessageBatchResult.Failed, err
+		})
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d of %d messages from sqs", failed, pending)
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Successfully deleted %d messages from sqs.", pending)}
+	ex.logger.Log(&lm)
+
+	return nil
+}
+
+// ChangeMessageVisibilityBatch sets the visibility timeout of the messages of the given responses, in seconds from
+// now, in batches of at most model.MaxBatchEntries. It extends the visibility of messages still in flight or, with a
+// timeout of 0, releases them so that they are redelivered right away. Responses without a receipt handle are skipped.
+func (ex extractor) ChangeMessageVisibilityBatch(ctx context.Context, responses []*model.Response, visibilityTimeout int) error {
+	pending, failed := ex.sendBatch(ctx, "ChangeMessageVisibilityBatch", "ChangeMessageVisibilityBatchRequestEntry", responses,
+		map[string]interface{}{"VisibilityTimeout": visibilityTimeout},
+		func(response *sqsResponse) ([]model.BatchResultErrorEntry, error) {
+			var changeResponse model.ChangeMessageVisibilityBatchResponse
+			err := response.decode(&changeResponse, &changeResponse.ChangeMessageVisibilityBatchResult)
+
+			return changeResponse.ChangeMessageVisibilityBatchResult.Failed, err
+		})
+
+	if failed > 0 {
+		return fmt.Errorf("failed to change the visibility of %d of %d messages", failed, pending)
+	}
+
+	return nil
+}
+
+// VisibilityTimeout returns the visibility timeout, in seconds, of the received messages: the configured one or else
+// the default visibility timeout of the queue, read with GetQueueAttributes. An error is returned when it cannot be
+// read or when it is 0, received messages then being visible again right away.
+func (ex extractor) VisibilityTimeout(ctx context.Context) (int, error) {
+	if ex.visibilityTimeout > 0 {
+		return ex.visibilityTimeout, nil
+	}
+
+	params := url.Values{}
+	params.Set("AttributeName.1", model.AttributeVisibilityTimeout)
+
+	response, err := ex.call(ctx, "GetQueueAttributes", params, map[string]interface{}{
+		"AttributeNames": []string{model.AttributeVisibilityTimeout},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var attributesResponse model.GetQueueAttributesResponse
+	err = response.decode(&attributesResponse, &attributesResponse.GetQueueAttributesResult)
+	if err != nil {
+		return 0, err
+	}
+
+	visibilityTimeout, err := strconv.Atoi(attributesResponse.GetQueueAttributesResult.Attributes[model.AttributeVisibilityTimeout])
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid visibility timeout of the queue: %v", err.Error()))
+	}
+
+	if visibilityTimeout <= 0 {
+		return 0, errors.New("the visibility timeout of the queue is 0, set SQS_VISIBILITY_TIMEOUT")
+	}
+
+	return visibilityTimeout, nil
+}
+
+// sendBatch sends a batch action for the responses with a receipt handle, in chunks of at most model.MaxBatchEntries.
+// The entries of the action, named entryName in the query protocol, hold the receipt handle of their response and
+// the given fields, entry ids being the index of the response in the chunk. decode returns the failed entries of a
+// response. The number of responses sent is returned along with the number of them that failed.
+func (ex extractor) sendBatch(ctx context.Context, action string, entryName string, responses []*model.Response, fields map[string]interface{},
+	decode func(response *sqsResponse) ([]model.BatchResultErrorEntry, error)) (int, int) {
+	var pending []*model.Response
+	for _, response := range responses {
+		if response != nil && response.ReceiptHandle != "" {
+			pending = append(pending, response)
+		}
+	}
+
+	var failed int
+	for start := 0; start < len(pending); start += model.MaxBatchEntries {
+		end := start + model.MaxBatchEntries
+		if end > len(pending) {
+			end = len(pending)
+		}
+
+		chunk := pending[start:end]
+
+		// Build the batch entries, entry ids are the index of the response in the chunk.
+		params := url.Values{}
+		entries := make([]map[string]interface{}, 0, len(chunk))
+		for i, response := range chunk {
+			entry := map[string]interface{}{"Id": fmt.Sprintf("msg-%d", i), "ReceiptHandle": response.ReceiptHandle}
+			for name, value := range fields {
+				entry[name] = value
+			}
+
+			for name, value := range entry {
+				params.Set(fmt.Sprintf("%v.%d.%v", entryName, i+1, name), fmt.Sprint(value))
+			}
+
+			entries = append(entries, entry)
+		}
+
+		response, err := ex.call(ctx, action, params, map[string]interface{}{"Entries": entries})
+		if err != nil {
+			failed += len(chunk)
+			continue
+		}
+
+		failedEntries, err := decode(response)
 		if err != nil {
-			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error unmarshalling JSON body from XML response from sqs enpoint : %v", err.Error())}
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error unmarshalling response of %v: %v", action, err.Error())}
+			ex.logger.Log(&lm)
+
+			failed += len(chunk)
+			continue
+		}
+
+		for _, entry := range failedEntries {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error in %v for message %v: %v %v", action, ex.messageIdOf(chunk, entry.Id), entry.Code, entry.Message)}
 			ex.logger.Log(&lm)
 
-			fmt.Println("Error unmarshalling JSON body:", err)
+			failed++
+		}
+	}
+
+	return len(pending), failed
+}
+
+// messageIdOf resolves a batch entry id back to the SQS message id of the response it was built from.
+func (ex extractor) messageIdOf(chunk []*model.Response, entryId string) string {
+	var idx int
+	_, err := fmt.Sscanf(entryId, "msg-%d", &idx)
+	if err != nil || idx < 0 || idx >= len(chunk) || chunk[idx].MessageId == nil {
+		return entryId
+	}
+
+	return *chunk[idx].MessageId
+}
+
+// sqsResponse is the body of a successful response of SQS along with its wire format.
+type sqsResponse struct {
+	body      []byte
+	json      bool
+	requestId *string
+}
+
+// decode unmarshals the response into envelope, the whole XML response of the query protocol, or into result, the
+// part of the envelope holding the result, which is the whole response of the JSON protocol.
+func (r *sqsResponse) decode(envelope interface{}, result interface{}) error {
+	if r.json {
+		return json.Unmarshal(r.body, result)
+	}
+
+	return xml.Unmarshal(r.body, envelope)
+}
+
+// call sends the given action to SQS, signed when credentials are configured, with params in the query protocol or
+// input in the JSON protocol, and returns the response. The queue url is added to the parameters.
+func (ex extractor) call(ctx context.Context, action string, params url.Values, input map[string]interface{}) (*sqsResponse, error) {
+	queueURL, err := ex.queueURL()
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error parsing sqs enpoint: %v", err.Error())}
+		ex.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	endpoint := queueURL
+	var payload []byte
+	var contentType string
+
+	if ex.protocol == SQSProtocolJSON {
+		// Requests of the JSON protocol are sent to the service endpoint and name the queue in their body.
+		input["QueueUrl"] = queueURL
+
+		payload, err = json.Marshal(input)
+		if err != nil {
 			return nil, err
 		}
 
-		// Set additional data from the SQS message response into the Response struct.
-		res.SetData(sqsMessageResponse)
+		endpoint, err = ex.serviceURL()
+		if err != nil {
+			return nil, err
+		}
+
+		contentType = sqsJSONContentType
+	} else {
+		params.Set("Action", action)
+		params.Set("Version", sqsAPIVersion)
+
+		payload = []byte(params.Encode())
+		contentType = "application/x-www-form-urlencoded"
 	}
 
-	// Mask sensitive data in the Response struct.
-	err = res.MaskBody(ex.encryptionKey)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error creating %v request to sqs enpoint: %v", action, err.Error())}
+		ex.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if ex.protocol == SQSProtocolJSON {
+		req.Header.Set("X-Amz-Target", sqsJSONTargetPrefix+action)
+	}
+
+	if ex.signer != nil {
+		ex.signer.Sign(req, payload, time.Now())
+	}
+
+	resp, err := ex.httpClient.Do(req)
 	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error sending %v request to sqs enpoint: %v", action, err.Error())}
+		ex.logger.Log(&lm)
+
 		return nil, err
 	}
 
-	// Validation of fields
-	//_ = res.Validation()
+	defer resp.Body.Close()
 
-	// Return the populated Response struct.
-	return &res, nil
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error reading %v response from sqs enpoint: %v", action, err.Error())}
+		ex.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	response := &sqsResponse{
+		body: body,
+		json: strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-amz-json") || strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"),
+	}
+
+	if requestId := resp.Header.Get("X-Amzn-Requestid"); requestId != "" {
+		response.requestId = &requestId
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var code, message string
+		if response.json {
+			var errResponse model.JSONErrorResponse
+			_ = json.Unmarshal(body, &errResponse)
+
+			code, message = errResponse.Type[strings.LastIndex(errResponse.Type, "#")+1:], errResponse.Message
+		} else {
+			var errResponse model.ErrorResponse
+			_ = xml.Unmarshal(body, &errResponse)
+
+			code, message = errResponse.Error.Code, errResponse.Error.Message
+		}
+
+		err = &sqsError{action: action, statusCode: resp.StatusCode, code: code, message: message}
+
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error response from sqs enpoint: %v", err.Error())}
+		ex.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// sqsError is the error response of SQS to an action.
+type sqsError struct {
+	action     string
+	statusCode int
+	code       string
+	message    string
+}
+
+func (e *sqsError) Error() string {
+	return fmt.Sprintf("%v failed with status %v: %v %v", e.action, e.statusCode, e.code, e.message)
+}
+
+// isRetryableSQSError reports whether a call failed because SQS could not be reached or failed to serve it, rather
+// than rejecting it, while ctx is still live.
+func isRetryableSQSError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var sqsErr *sqsError
+	if errors.As(err, &sqsErr) {
+		return sqsErr.statusCode >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// newReceiveRequestAttemptId returns a random ReceiveRequestAttemptId.
+func newReceiveRequestAttemptId() (string, error) {
+	id := make([]byte, 16)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// queueURL returns the SQS endpoint without its query string, which is the url of the queue itself.
+func (ex extractor) queueURL() (string, error) {
+	endpoint, err := url.Parse(ex.sqsEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint.RawQuery = ""
+
+	return endpoint.String(), nil
+}
+
+// serviceURL returns the root of the SQS endpoint, to which the requests of the JSON protocol are sent.
+func (ex extractor) serviceURL() (string, error) {
+	endpoint, err := url.Parse(ex.sqsEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint.Path = "/"
+	endpoint.RawPath = ""
+	endpoint.RawQuery = ""
+
+	return endpoint.String(), nil
 }
@@ -0,0 +1,228 @@
+package etl
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// wireFormats are the SQS protocols along with the extension of their recorded responses in testdata and the content
+// type SQS sends them with.
+var wireFormats = []struct {
+	protocol    string
+	extension   string
+	contentType string
+}{
+	{SQSProtocolQuery, ".xml", "text/xml"},
+	{SQSProtocolJSON, ".json", sqsJSONContentType},
+}
+
+// newFixtureExtractor returns an extractor sending its requests in the protocol to a stub of SQS responding with the
+// recorded response testdata/<fixture><extension> and the status code.
+func newFixtureExtractor(t *testing.T, protocol string, fixture string, contentType string, statusCode int) *extractor {
+	t.Helper()
+
+	body, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Amzn-Requestid", "stub-request-id")
+		w.WriteHeader(statusCode)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	logger, err := log.NewCustomLogger(filepath.Join(t.TempDir(), "logs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ex, err := NewExtractor(logger, nil, nil, nil, nil, ExtractorConfig{
+		SQSEndpoint: server.URL + "/000000000000/login-queue?Action=ReceiveMessage",
+		Protocol:    protocol,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ex.(*extractor)
+}
+
+func stringOf(value string) *string {
+	return &value
+}
+
+func TestDecodeReceiveMessage(t *testing.T) {
+	want := []*model.Message{
+		{
+			MessageId:     stringOf("c579b1c9-e6a4-4a6d-9d35-8e7a6a2e3f4b"),
+			ReceiptHandle: "AQEBzWwaftRI0KuVm4tP+/7q1rGgNqicHq/e8HxrsYWadmYjMMAh1ky1uWw0V5tUSY4=",
+			MD5OfBody:     "e4f1de8c099c0acd7cb05ba9e790ac02",
+			Body:          `{"user_id": "424cdd21-063a-43a7-b91b-7ca1a833afae", "app_version": "2.3.0", "device_type": "android", "ip": "199.172.111.135", "locale": "RU", "device_id": "593-47-5928"}`,
+			Attributes: model.Attributes{
+				"SenderId":                                      "AIDAIT2UOQQY3AUEKVGXU",
+				model.AttributeSentTimestamp:                    "1718701936000",
+				model.AttributeApproximateReceiveCount:          "1",
+				model.AttributeApproximateFirstReceiveTimestamp: "1718701936221",
+			},
+			MessageAttributes: model.MessageAttributes{
+				"source":  {DataType: "String", StringValue: "mobile"},
+				"retries": {DataType: "Number", StringValue: "0"},
+			},
+		},
+		{
+			MessageId:     stringOf("8f3d6e2a-1b7c-4c5d-9e0f-2a3b4c5d6e7f"),
+			ReceiptHandle: "AQEBKzCO1W2ExKVXqW4y4bFGbrHqC5IrHVA2bVTmMZ08F+ZP2KwzM5rAkF7C9i0hGKk=",
+			MD5OfBody:     "347f6ce29bd4f361b13bc54c05d0a5fc",
+			Body:          `{"user_id": "c0173198-76a8-4e67-bfc2-74eaa3bbff57", "app_version": "0.2.6", "device_type": "ios", "ip": "241.6.88.151", "locale": "PH", "device_id": "104-25-0070"}`,
+			Attributes: model.Attributes{
+				"SenderId":                                      "AIDAIT2UOQQY3AUEKVGXU",
+				model.AttributeSentTimestamp:                    "1718701937512",
+				model.AttributeApproximateReceiveCount:          "3",
+				model.AttributeApproximateFirstReceiveTimestamp: "1718701940004",
+			},
+			MessageAttributes: model.MessageAttributes{
+				"trace": {DataType: "Binary", BinaryValue: "dHJhY2UtMDAx"},
+			},
+		},
+	}
+
+	for _, format := range wireFormats {
+		t.Run(format.protocol, func(t *testing.T) {
+			ex := newFixtureExtractor(t, format.protocol, "receive_message"+format.extension, format.contentType, http.StatusOK)
+
+			response, err := ex.call(context.Background(), "ReceiveMessage", url.Values{}, map[string]interface{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var received model.ReceiveMessageResponse
+			err = response.decode(&received, &received.ReceiveMessageResult)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages := received.ReceiveMessageResult.Messages
+			for _, message := range messages {
+				message.XMLName = xml.Name{}
+			}
+
+			if !reflect.DeepEqual(messages, want) {
+				t.Errorf("decoded messages\n%+v\nwant\n%+v", messages, want)
+			}
+
+			// Both protocols yield the same logins, dated by their SentTimestamp, with an intact body.
+			if !messages[0].VerifyMD5() || !messages[1].VerifyMD5() {
+				t.Error("decoded bodies do not match their MD5OfBody")
+			}
+
+			var res model.Response
+			res.SetData(received.ResponseMetadata.RequestId, messages[1])
+
+			if res.SentAt == nil || res.SentAt.UnixMilli() != 1718701937512 || res.ReceiveCount == nil || *res.ReceiveCount != 3 {
+				t.Errorf("response attributes %v %v, want the SentTimestamp and ApproximateReceiveCount", res.SentAt, res.ReceiveCount)
+			}
+		})
+	}
+}
+
+func TestDecodeDeleteMessageBatch(t *testing.T) {
+	want := model.DeleteMessageBatchResult{
+		Successful: []model.DeleteMessageBatchResultEntry{{Id: "msg-0"}},
+		Failed: []model.BatchResultErrorEntry{
+			{Id: "msg-1", Code: "ReceiptHandleIsInvalid", Message: "The input receipt handle is invalid.", SenderFault: true},
+		},
+	}
+
+	for _, format := range wireFormats {
+		t.Run(format.protocol, func(t *testing.T) {
+			ex := newFixtureExtractor(t, format.protocol, "delete_message_batch"+format.extension, format.contentType, http.StatusOK)
+
+			response, err := ex.call(context.Background(), "DeleteMessageBatch", url.Values{}, map[string]interface{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var deleted model.DeleteMessageBatchResponse
+			err = response.decode(&deleted, &deleted.DeleteMessageBatchResult)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := deleted.DeleteMessageBatchResult
+			result.XMLName = xml.Name{}
+
+			if !reflect.DeepEqual(result, want) {
+				t.Errorf("decoded result\n%+v\nwant\n%+v", result, want)
+			}
+
+			// The failed entry is reported as a failure of the batch.
+			responses := []*model.Response{{ReceiptHandle: "handle-0"}, {ReceiptHandle: "handle-1"}}
+			if err = ex.DeleteMessageBatch(context.Background(), responses); err == nil {
+				t.Error("DeleteMessageBatch succeeded, want the failed entry reported")
+			}
+		})
+	}
+}
+
+func TestDecodeErrorResponse(t *testing.T) {
+	// The JSON protocol names the errors differently.
+	codes := map[string][2]string{
+		SQSProtocolQuery: {"AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist for this wsdl version."},
+		SQSProtocolJSON:  {"QueueDoesNotExist", "The specified queue does not exist."},
+	}
+
+	for _, format := range wireFormats {
+		t.Run(format.protocol, func(t *testing.T) {
+			ex := newFixtureExtractor(t, format.protocol, "error"+format.extension, format.contentType, http.StatusBadRequest)
+
+			_, err := ex.call(context.Background(), "ReceiveMessage", url.Values{}, map[string]interface{}{})
+
+			var sqsErr *sqsError
+			if !errors.As(err, &sqsErr) {
+				t.Fatalf("error %v, want an sqsError", err)
+			}
+
+			want := codes[format.protocol]
+			if sqsErr.statusCode != http.StatusBadRequest || sqsErr.code != want[0] || sqsErr.message != want[1] {
+				t.Errorf("error %+v, want code %q and message %q", sqsErr, want[0], want[1])
+			}
+
+			if isRetryableSQSError(context.Background(), err) {
+				t.Error("a rejected call is reported as retryable")
+			}
+		})
+	}
+}
+
+func TestVisibilityTimeoutOfQueue(t *testing.T) {
+	for _, format := range wireFormats {
+		t.Run(format.protocol, func(t *testing.T) {
+			ex := newFixtureExtractor(t, format.protocol, "get_queue_attributes"+format.extension, format.contentType, http.StatusOK)
+
+			visibilityTimeout, err := ex.VisibilityTimeout(context.Background())
+			if err != nil || visibilityTimeout != 45 {
+				t.Errorf("VisibilityTimeout = %d, %v, want the 45s of the queue", visibilityTimeout, err)
+			}
+
+			// The configured visibility timeout takes precedence over the queue's.
+			ex.visibilityTimeout = 60
+			visibilityTimeout, err = ex.VisibilityTimeout(context.Background())
+			if err != nil || visibilityTimeout != 60 {
+				t.Errorf("VisibilityTimeout = %d, %v, want the configured 60s", visibilityTimeout, err)
+			}
+		})
+	}
+}
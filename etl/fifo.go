@@ -0,0 +1,89 @@
+package etl
+
+import (
+	"errors"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"sort"
+)
+
+// errGroupHeld is the error of the rows that were not inserted as an earlier message of their group was not loaded.
+var errGroupHeld = errors.New("an earlier message of the message group was left on the queue")
+
+// heldGroups are the FIFO message groups a message of which was left on the queue, by the ReceiveRequestAttemptId of
+// the call that received it. SQS does not deliver the following messages of a group while one of them is in flight,
+// the messages of a held group received by that call are then left on the queue as well so that the group is
+// redelivered, and loaded, in sequence order. The group is released once one of its messages is received by another
+// call, which is a redelivery.
+type heldGroups map[string]string
+
+// hold holds the group of the response, when it was received from a FIFO queue.
+func (h heldGroups) hold(response *model.Response) {
+	if response.MessageGroupId == nil || response.ReceiveRequestAttemptId == "" {
+		return
+	}
+
+	h[*response.MessageGroupId] = response.ReceiveRequestAttemptId
+}
+
+// holds reports whether the response belongs to a held group and was received along with the message that was left
+// on the queue.
+func (h heldGroups) holds(response *model.Response) bool {
+	if response.MessageGroupId == nil || response.ReceiveRequestAttemptId == "" {
+		return false
+	}
+
+	attemptId, ok := h[*response.MessageGroupId]
+
+	return ok && attemptId == response.ReceiveRequestAttemptId
+}
+
+// split returns the responses of the batch that are not held, releasing the groups that were redelivered, along with
+// the row errors of the held ones, which are retryable.
+func (h heldGroups) split(batch []*model.Response) ([]*model.Response, []model.RowError) {
+	if len(h) == 0 {
+		return batch, nil
+	}
+
+	kept := make([]*model.Response, 0, len(batch))
+	var rowErrors []model.RowError
+	for _, response := range batch {
+		if h.holds(response) {
+			rowErrors = append(rowErrors, model.RowError{Response: response, Err: errGroupHeld, Retryable: true})
+			continue
+		}
+
+		if response.MessageGroupId != nil && response.ReceiveRequestAttemptId != "" {
+			delete(h, *response.MessageGroupId)
+		}
+
+		kept = append(kept, response)
+	}
+
+	return kept, rowErrors
+}
+
+// orderGroups sorts, in place, the responses of every FIFO message group of the batch by sequence number. The
+// responses of a group take the positions the group had in the batch, the other responses are left where they are.
+func orderGroups(batch []*model.Response) {
+	positions := make(map[string][]int)
+	for i, response := range batch {
+		if response.MessageGroupId != nil && response.SequenceNumber != nil {
+			positions[*response.MessageGroupId] = append(positions[*response.MessageGroupId], i)
+		}
+	}
+
+	for _, indexes := range positions {
+		group := make([]*model.Response, len(indexes))
+		for i, idx := range indexes {
+			group[i] = batch[idx]
+		}
+
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Precedes(group[j])
+		})
+
+		for i, idx := range indexes {
+			batch[idx] = group[i]
+		}
+	}
+}
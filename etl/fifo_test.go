@@ -0,0 +1,180 @@
+package etl
+
+import (
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"reflect"
+	"testing"
+)
+
+// fifoResponse returns the response of the message messageId of a FIFO message group, received by the
+// ReceiveMessage call attemptId. An empty group stands for a message of a standard queue.
+func fifoResponse(messageId string, group string, sequenceNumber string, attemptId string) *model.Response {
+	response := &model.Response{MessageId: &messageId, ReceiveRequestAttemptId: attemptId}
+	if group != "" {
+		response.MessageGroupId = &group
+		response.SequenceNumber = &sequenceNumber
+	}
+
+	return response
+}
+
+func TestHeldGroups(t *testing.T) {
+	tests := []struct {
+		name     string
+		held     []*model.Response
+		response *model.Response
+		holds    bool
+	}{
+		{"nothing held", nil, fifoResponse("m1", "g1", "1", "a1"), false},
+		{"group held by the same call", []*model.Response{fifoResponse("m1", "g1", "1", "a1")}, fifoResponse("m2", "g1", "2", "a1"), true},
+		{"group redelivered to another call", []*model.Response{fifoResponse("m1", "g1", "1", "a1")}, fifoResponse("m1", "g1", "1", "a2"), false},
+		{"other group of the same call", []*model.Response{fifoResponse("m1", "g1", "1", "a1")}, fifoResponse("m2", "g2", "1", "a1"), false},
+		{"standard queue message", []*model.Response{fifoResponse("m1", "", "", "")}, fifoResponse("m2", "", "", ""), false},
+		{"group held again by a later call", []*model.Response{fifoResponse("m1", "g1", "1", "a1"), fifoResponse("m1", "g1", "1", "a2")}, fifoResponse("m2", "g1", "2", "a1"), false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			held := make(heldGroups)
+			for _, response := range tc.held {
+				held.hold(response)
+			}
+
+			if holds := held.holds(tc.response); holds != tc.holds {
+				t.Errorf("holds = %v, want %v", holds, tc.holds)
+			}
+		})
+	}
+}
+
+func TestHeldGroupsSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		held     []*model.Response
+		batch    []*model.Response
+		kept     []string
+		rejected []string
+		// stillHeld are the groups held once the batch is split.
+		stillHeld []string
+	}{
+		{
+			name:  "nothing held",
+			batch: []*model.Response{fifoResponse("m1", "g1", "1", "a1"), fifoResponse("m2", "", "", "")},
+			kept:  []string{"m1", "m2"},
+		},
+		{
+			name:      "held group received by the same call",
+			held:      []*model.Response{fifoResponse("m1", "g1", "1", "a1")},
+			batch:     []*model.Response{fifoResponse("m2", "g1", "2", "a1"), fifoResponse("m3", "g2", "1", "a1"), fifoResponse("m4", "", "", "")},
+			kept:      []string{"m3", "m4"},
+			rejected:  []string{"m2"},
+			stillHeld: []string{"g1"},
+		},
+		{
+			name:  "held group redelivered",
+			held:  []*model.Response{fifoResponse("m1", "g1", "1", "a1")},
+			batch: []*model.Response{fifoResponse("m1", "g1", "1", "a2"), fifoResponse("m2", "g1", "2", "a2")},
+			kept:  []string{"m1", "m2"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			held := make(heldGroups)
+			for _, response := range tc.held {
+				held.hold(response)
+			}
+
+			kept, rowErrors := held.split(tc.batch)
+
+			var rejected []string
+			for _, rowErr := range rowErrors {
+				if !rowErr.Retryable || rowErr.Err != errGroupHeld {
+					t.Errorf("row error %v of %v, want retryable errGroupHeld", rowErr.Err, *rowErr.Response.MessageId)
+				}
+
+				rejected = append(rejected, *rowErr.Response.MessageId)
+			}
+
+			var stillHeld []string
+			for group := range held {
+				stillHeld = append(stillHeld, group)
+			}
+
+			if !reflect.DeepEqual(messageIdsOf(kept), tc.kept) || !reflect.DeepEqual(rejected, tc.rejected) || !reflect.DeepEqual(stillHeld, tc.stillHeld) {
+				t.Errorf("split kept %v, rejected %v, held %v, want %v, %v, %v", messageIdsOf(kept), rejected, stillHeld, tc.kept, tc.rejected, tc.stillHeld)
+			}
+		})
+	}
+}
+
+// TestHeldGroupAcrossBatches follows a group whose first message is left on the queue: its following messages
+// received by the same call are held in that batch and the next one, until the group is redelivered.
+func TestHeldGroupAcrossBatches(t *testing.T) {
+	held := make(heldGroups)
+
+	// The first message of g1 failed for a transient reason and was left on the queue.
+	held.hold(fifoResponse("m1", "g1", "1", "a1"))
+
+	// m2 is flushed in the same batch as m1, m3 in the next one, both received by the same call.
+	for _, batch := range [][]*model.Response{
+		{fifoResponse("m2", "g1", "2", "a1"), fifoResponse("m4", "g2", "1", "a1")},
+		{fifoResponse("m3", "g1", "3", "a1"), fifoResponse("m5", "g2", "2", "a1")},
+	} {
+		kept, rowErrors := held.split(batch)
+		if len(kept) != 1 || *kept[0].MessageGroupId != "g2" || len(rowErrors) != 1 || *rowErrors[0].Response.MessageGroupId != "g1" {
+			t.Fatalf("split kept %v with %d row errors, want the message of g2 only", messageIdsOf(kept), len(rowErrors))
+		}
+	}
+
+	// The group is redelivered in sequence order and released.
+	kept, rowErrors := held.split([]*model.Response{fifoResponse("m1", "g1", "1", "a2"), fifoResponse("m2", "g1", "2", "a2"), fifoResponse("m3", "g1", "3", "a2")})
+	if len(kept) != 3 || len(rowErrors) != 0 || len(held) != 0 {
+		t.Errorf("split of the redelivered group kept %v with %d row errors, %d groups held", messageIdsOf(kept), len(rowErrors), len(held))
+	}
+}
+
+func TestOrderGroups(t *testing.T) {
+	tests := []struct {
+		name  string
+		batch []*model.Response
+		want  []string
+	}{
+		{
+			name:  "standard queue messages left in place",
+			batch: []*model.Response{fifoResponse("m2", "", "", ""), fifoResponse("m1", "", "", "")},
+			want:  []string{"m2", "m1"},
+		},
+		{
+			name:  "group sorted by sequence number",
+			batch: []*model.Response{fifoResponse("m3", "g1", "30", ""), fifoResponse("m1", "g1", "10", ""), fifoResponse("m2", "g1", "20", "")},
+			want:  []string{"m1", "m2", "m3"},
+		},
+		{
+			name:  "sequence numbers compared as integers",
+			batch: []*model.Response{fifoResponse("m2", "g1", "100", ""), fifoResponse("m1", "g1", "99", "")},
+			want:  []string{"m1", "m2"},
+		},
+		{
+			name: "groups sorted within their positions",
+			batch: []*model.Response{fifoResponse("b2", "g2", "2", ""), fifoResponse("a2", "g1", "2", ""), fifoResponse("s", "", "", ""),
+				fifoResponse("b1", "g2", "1", ""), fifoResponse("a1", "g1", "1", "")},
+			want: []string{"b1", "a1", "s", "b2", "a2"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			orderGroups(tc.batch)
+
+			var got []string
+			for _, response := range tc.batch {
+				got = append(got, *response.MessageId)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("orderGroups = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
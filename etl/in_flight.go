@@ -0,0 +1,77 @@
+package etl
+
+import (
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"sync"
+)
+
+// inFlight tracks the responses received from SQS that are neither acknowledged nor left on the queue yet: from the
+// moment a worker receives them, while they wait in the results channel and in the batch, until their batch is
+// flushed. The heartbeat extends the visibility of their messages so that they are not redelivered meanwhile.
+type inFlight struct {
+	mu        sync.Mutex
+	responses map[*model.Response]struct{}
+	// extending is held by the heartbeat while it extends the visibility of a snapshot of the responses, untrack waits
+	// for it so that the responses are no longer extended once it returns, e.g. before their messages are released.
+	extending sync.Mutex
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{responses: make(map[*model.Response]struct{})}
+}
+
+// track adds a response received from SQS.
+func (f *inFlight) track(response *model.Response) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.responses[response] = struct{}{}
+}
+
+// untrack removes the responses of a flushed batch, once any extension of their visibility in progress is done.
+func (f *inFlight) untrack(responses []*model.Response) {
+	f.extending.Lock()
+	defer f.extending.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, response := range responses {
+		delete(f.responses, response)
+	}
+}
+
+// drain removes and returns all the responses, once any extension of their visibility in progress is done, so that
+// they are no longer extended.
+func (f *inFlight) drain() []*model.Response {
+	f.extending.Lock()
+	defer f.extending.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	responses := make([]*model.Response, 0, len(f.responses))
+	for response := range f.responses {
+		responses = append(responses, response)
+		delete(f.responses, response)
+	}
+
+	return responses
+}
+
+// extend calls extendVisibility with the responses in flight, if any, untrack waiting for it to return.
+func (f *inFlight) extend(extendVisibility func(responses []*model.Response)) {
+	f.extending.Lock()
+	defer f.extending.Unlock()
+
+	f.mu.Lock()
+	responses := make([]*model.Response, 0, len(f.responses))
+	for response := range f.responses {
+		responses = append(responses, response)
+	}
+	f.mu.Unlock()
+
+	if len(responses) > 0 {
+		extendVisibility(responses)
+	}
+}
@@ -3,18 +3,44 @@ package etl
 import (
 	"context"
 	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"time"
 )
 
 type Processor interface {
 	Worker(ctx context.Context, id int, results chan<- *model.Response)
-	ProcessDataFromWorker(ctx context.Context, results chan *model.Response)
+	ProcessDataFromWorker(ctx context.Context, results <-chan *model.Response) error
+	Heartbeat(ctx context.Context, visibilityTimeout int)
+	Release(ctx context.Context)
+	Replay(ctx context.Context, batchSize int) (replayed int, failed int, err error)
 }
 
 type Extract interface {
-	FetchDataFromSQS() (*model.Response, error)
+	FetchDataFromSQS(ctx context.Context) ([]*model.Response, error)
+	Transform(ctx context.Context, masker model.Masker, requestId *string, message *model.Message) (*model.Response, error)
+	DeleteMessageBatch(ctx context.Context, responses []*model.Response) error
+	ChangeMessageVisibilityBatch(ctx context.Context, responses []*model.Response, visibilityTimeout int) error
+	VisibilityTimeout(ctx context.Context) (int, error)
 }
 
 type Loader interface {
 	BatchInsert(ctx context.Context, responses []*model.Response) error
-	SequentialInsert(ctx context.Context, response []model.Response) error
+	SequentialInsert(ctx context.Context, responses []*model.Response) []model.RowError
+}
+
+type Quarantine interface {
+	Store(ctx context.Context, message *model.QuarantinedMessage) error
+}
+
+type DeadLetter interface {
+	Store(ctx context.Context, letters []*model.DeadLetter) error
+	Pending(ctx context.Context, afterId int64, limit int) ([]*model.DeadLetter, error)
+	MarkReplayed(ctx context.Context, messageIds []string) error
+}
+
+type Remasker interface {
+	Remask(ctx context.Context, batchSize int, pause time.Duration) (remasked int, err error)
+}
+
+type Eraser interface {
+	Erase(ctx context.Context, request *model.ErasureRequest) (*model.Erasure, error)
 }
@@ -3,10 +3,15 @@ package etl
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/shivasaicharanruthala/dataops-takehome/log"
 	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type loader struct {
@@ -22,37 +27,284 @@ func NewLoader(logger *log.CustomLogger, dbConn *sql.DB) Loader {
 	}
 }
 
-// BatchInsert inserts a batch of responses into the PostgreSQL database.
+// loginColumns are the columns of user_logins written for every response, in the order of loginValues.
+var loginColumns = []string{"message_id", "request_id", "user_id", "user_id_index", "device_type", "masked_ip", "ip_index", "masked_device_id", "device_id_index", "locale", "app_version", "create_date",
+	"sent_timestamp", "approximate_receive_count", "approximate_first_receive_timestamp", "loaded_at"}
+
+// loginValues returns the values of the response loaded at loadedAt for loginColumns. The create_date is the date the
+// message was sent, the load date standing in for it when the SentTimestamp attribute is missing.
+func loginValues(response *model.Response, loadedAt time.Time) []interface{} {
+	createDate := loadedAt
+	if response.SentAt != nil {
+		createDate = *response.SentAt
+	}
+
+	return []interface{}{response.MessageId, response.RequestId, response.UserID, response.UserIDIndex, response.DeviceType, response.IP, response.IPIndex, response.DeviceID, response.DeviceIDIndex, response.Locale, response.AppVersion, createDate,
+		response.SentAt, response.ReceiveCount, response.FirstReceivedAt, loadedAt}
+}
+
+// BatchInsert inserts a batch of responses into the PostgreSQL database. Responses whose message was already loaded
+// are skipped, which makes redelivered messages idempotent, as are the responses sent before the erasure of their
+// user.
 func (l *loader) BatchInsert(ctx context.Context, responses []*model.Response) error {
+	tx, err := l.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to begin batch insert transaction with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	defer tx.Rollback()
+
+	batchSize := len(responses)
+	responses, err = l.dropErased(ctx, tx, responses)
+	if err != nil {
+		return err
+	}
+
+	if len(responses) == 0 {
+		return tx.Commit()
+	}
+
+	// Postgres takes at most maxBindParameters bind parameters per statement, larger batches are inserted in chunks
+	// of the same transaction.
+	loadedAt := time.Now().UTC()
+	var inserted int64
+	for start := 0; start < len(responses); start += maxInsertRows {
+		end := start + maxInsertRows
+		if end > len(responses) {
+			end = len(responses)
+		}
+
+		rows, err := l.insertChunk(ctx, tx, responses[start:end], loadedAt)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to execute batch insert with error : %v", err.Error())}
+			l.logger.Log(&lm)
+
+			return err
+		}
+
+		inserted += rows
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to commit batch insert with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return err
+	}
+
+	l.logInserted(inserted, batchSize, batchSize-len(responses))
+
+	return nil
+}
+
+// maxBindParameters is the maximum number of bind parameters of a postgres statement.
+const maxBindParameters = 65535
+
+// maxInsertRows is the maximum number of rows of a multi-row insert into user_logins.
+var maxInsertRows = maxBindParameters / len(loginColumns)
+
+// insertChunk inserts the responses, at most maxInsertRows, with a multi-row insert and returns the number of rows
+// inserted.
+func (l *loader) insertChunk(ctx context.Context, tx *sql.Tx, responses []*model.Response, loadedAt time.Time) (int64, error) {
 	// Initialize slices to build the SQL statement
-	valueStrings := make([]string, 0, len(responses))     // Slice to hold value placeholders
-	valueArgs := make([]interface{}, 0, len(responses)*6) // Slice to hold the actual values
+	valueStrings := make([]string, 0, len(responses))                     // Slice to hold value placeholders
+	valueArgs := make([]interface{}, 0, len(responses)*len(loginColumns)) // Slice to hold the actual values
 
 	// Iterate over the responses and construct the values part of the SQL statement
-	for i, response := range responses {
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, NOW() AT TIME ZONE 'UTC')", i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6))
-		valueArgs = append(valueArgs, response.UserID, response.DeviceType, response.IP, response.DeviceID, response.Locale, response.AppVersion)
+	for _, response := range responses {
+		placeholders := make([]string, 0, len(loginColumns))
+		for range loginColumns {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(valueArgs)+len(placeholders)+1))
+		}
+
+		valueStrings = append(valueStrings, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+		valueArgs = append(valueArgs, loginValues(response, loadedAt)...)
 	}
 
 	// Join the value strings to form the complete SQL statement
-	stmt := fmt.Sprintf("INSERT INTO user_logins (user_id, device_type, masked_ip, masked_device_id, locale, app_version, create_date) VALUES %s",
-		strings.Join(valueStrings, ","))
+	stmt := fmt.Sprintf("INSERT INTO user_logins (%s) VALUES %s ON CONFLICT (message_id) DO NOTHING",
+		strings.Join(loginColumns, ", "), strings.Join(valueStrings, ","))
 
 	// Execute the SQL statement with the value arguments
-	_, err := l.dbConn.Exec(stmt, valueArgs...)
+	result, err := tx.ExecContext(ctx, stmt, valueArgs...)
 	if err != nil {
-		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to execute batch insert with error : %v", err.Error())}
-		l.logger.Log(&lm)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// SequentialInsert inserts the responses one row at a time and reports the rows that failed to be inserted. The
+// responses sent before the erasure of their user are skipped.
+func (l *loader) SequentialInsert(ctx context.Context, responses []*model.Response) []model.RowError {
+	placeholders := make([]string, 0, len(loginColumns))
+	for i := range loginColumns {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO user_logins (%s) VALUES (%s) ON CONFLICT (message_id) DO NOTHING",
+		strings.Join(loginColumns, ", "), strings.Join(placeholders, ", "))
+
+	var rowErrors []model.RowError
+	loadedAt := time.Now().UTC()
+	for _, response := range responses {
+		err := l.insertRow(ctx, stmt, response, loadedAt)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to insert message %v with error : %v", stringValue(response.MessageId), err.Error())}
+			l.logger.Log(&lm)
+
+			rowErrors = append(rowErrors, model.RowError{Response: response, Err: err, Retryable: !isDataError(err)})
+		}
+	}
 
+	return rowErrors
+}
+
+// insertRow inserts a single response with stmt in a transaction of its own, unless it was sent before the erasure of
+// its user.
+func (l *loader) insertRow(ctx context.Context, stmt string, response *model.Response, loadedAt time.Time) error {
+	tx, err := l.dbConn.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
 
-	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Successfully inserted a batch to database.")}
-	l.logger.Log(&lm)
+	defer tx.Rollback()
 
-	return nil
+	kept, err := l.dropErased(ctx, tx, []*model.Response{response})
+	if err != nil || len(kept) == 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, stmt, loginValues(response, loadedAt)...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (l *loader) SequentialInsert(ctx context.Context, responses []model.Response) error {
-	return nil
+// erasureLockClass is the first key of the advisory locks taken on users, the second one being the hash of the blind
+// index of their user id.
+const erasureLockClass = 1701
+
+// lockUsers takes, in the transaction, a shared advisory lock on the users of the responses, which the eraser takes
+// exclusively. An erasure then commits either before the statements that follow, which see it, or after the
+// transaction, and deletes the rows it inserted.
+func lockUsers(ctx context.Context, tx *sql.Tx, responses []*model.Response) error {
+	indexes := userIDIndexes(responses)
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock_shared($1, hashtext(user_id_index)) FROM unnest($2::text[]) AS user_id_index", erasureLockClass, pq.Array(indexes))
+
+	return err
+}
+
+// userIDIndexes returns the sorted blind indexes of the user ids of the responses.
+func userIDIndexes(responses []*model.Response) []string {
+	indexes := make([]string, 0, len(responses))
+	for _, response := range responses {
+		if response.UserIDIndex != nil {
+			indexes = append(indexes, *response.UserIDIndex)
+		}
+	}
+
+	sort.Strings(indexes)
+
+	return indexes
+}
+
+// dropErased locks the users of the responses in the transaction and returns the responses that were not erased, see
+// notErased, the others are not loaded and are acknowledged like loaded ones.
+func (l *loader) dropErased(ctx context.Context, tx *sql.Tx, responses []*model.Response) ([]*model.Response, error) {
+	err := lockUsers(ctx, tx, responses)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to lock users with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return nil, err
+	}
+
+	indexes := userIDIndexes(responses)
+
+	if len(indexes) == 0 {
+		return responses, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT user_id_index, max(requested_at) FROM user_logins_erasures WHERE user_id_index = ANY($1) GROUP BY user_id_index", pq.Array(indexes))
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to fetch erased users with error : %v", err.Error())}
+		l.logger.Log(&lm)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	erasedAt := make(map[string]time.Time)
+	for rows.Next() {
+		var index string
+		var requestedAt time.Time
+
+		err = rows.Scan(&index, &requestedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		erasedAt[index] = requestedAt
+	}
+
+	err = rows.Err()
+	if err != nil || len(erasedAt) == 0 {
+		return responses, err
+	}
+
+	kept := notErased(responses, erasedAt)
+	if len(kept) < len(responses) {
+		lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Skipped %d messages sent before the erasure of their user.", len(responses)-len(kept))}
+		l.logger.Log(&lm)
+	}
+
+	return kept, nil
+}
+
+// notErased returns the responses that were not erased given the time their users were last erased at: the responses
+// of users never erased and the ones sent after the erasure of their user, which are new logins. A response without
+// SentTimestamp cannot be told apart from a redelivered message of the erased user and is dropped.
+func notErased(responses []*model.Response, erasedAt map[string]time.Time) []*model.Response {
+	kept := make([]*model.Response, 0, len(responses))
+	for _, response := range responses {
+		if response.UserIDIndex != nil {
+			requestedAt, erased := erasedAt[*response.UserIDIndex]
+			if erased && (response.SentAt == nil || !response.SentAt.After(requestedAt)) {
+				continue
+			}
+		}
+
+		kept = append(kept, response)
+	}
+
+	return kept
+}
+
+// logInserted logs the number of rows inserted out of the batch, the difference being the messages of erased users
+// and the messages loaded before.
+func (l *loader) logInserted(inserted int64, batchSize int, erased int) {
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Successfully inserted a batch to database, %d of %d rows new, %d erased and %d duplicates skipped.", inserted, batchSize, erased, int64(batchSize-erased)-inserted)}
+	l.logger.Log(&lm)
+}
+
+// isDataError reports whether err is raised by postgres because of the data of a row, a data exception or an
+// integrity constraint violation, as opposed to a failure of the connection or the server.
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	return pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23"
 }
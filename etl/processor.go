@@ -2,6 +2,7 @@ package etl
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/shivasaicharanruthala/dataops-takehome/log"
 	"github.com/shivasaicharanruthala/dataops-takehome/model"
@@ -13,23 +14,36 @@ import (
 )
 
 type transformer struct {
-	logger    *log.CustomLogger
-	extractor Extract
-	loader    Loader
-	wg        *sync.WaitGroup
+	logger     *log.CustomLogger
+	extractor  Extract
+	loader     Loader
+	deadLetter DeadLetter
+	masker     model.Masker
+	wg         *sync.WaitGroup
+	inFlight   *inFlight
 }
 
-// NewProcessor creates a new instance of the Processor with the given extractor and loader.
-func NewProcessor(logger *log.CustomLogger, wg *sync.WaitGroup, extractor Extract, loader Loader) Processor {
+// NewProcessor creates a new instance of the Processor with the given extractor, loader and dead letter sink. The
+// masker masks the replayed dead letters.
+func NewProcessor(logger *log.CustomLogger, wg *sync.WaitGroup, extractor Extract, loader Loader, deadLetter DeadLetter, masker model.Masker) Processor {
 	return &transformer{
-		logger:    logger,
-		extractor: extractor,
-		loader:    loader,
-		wg:        wg,
+		logger:     logger,
+		extractor:  extractor,
+		loader:     loader,
+		deadLetter: deadLetter,
+		masker:     masker,
+		wg:         wg,
+		inFlight:   newInFlight(),
 	}
 }
 
-// Worker is a function that continuously calls the API to fetch data and sends the result to a channel.
+// maxEmptyResponseWait is the longest wait between two polls of an empty queue.
+const maxEmptyResponseWait = time.Minute
+
+// Worker is a function that continuously calls the API to fetch batches of data and sends the results to a channel.
+// Once the queue stayed empty for MAX_NO_RESPONSES calls, it waits longer between polls, up to maxEmptyResponseWait.
+// It stops once ctx is cancelled or, when MAX_CONSECUTIVE_NO_RESPONSES is set, once the queue stayed empty for that
+// many calls; an idle worker keeps polling by default.
 func (p *transformer) Worker(ctx context.Context, id int, results chan<- *model.Response) {
 	defer p.wg.Done() // Ensure the WaitGroup counter is decremented when the function returns
 
@@ -48,7 +62,7 @@ func (p *transformer) Worker(ctx context.Context, id int, results chan<- *model.
 
 			return
 		default:
-			response, err := p.extractor.FetchDataFromSQS()
+			responses, err := p.extractor.FetchDataFromSQS(ctx)
 			if err != nil {
 				lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Worker %d: Error fetching data: %v", id, err.Error())}
 				p.logger.Log(&lm)
@@ -56,9 +70,18 @@ func (p *transformer) Worker(ctx context.Context, id int, results chan<- *model.
 				continue
 			}
 
-			// Send the valid response to the results channel if message exists.
-			if response != nil && response.MessageId != nil && response.UserID != nil {
-				results <- response
+			// Send the valid responses to the results channel if messages exist, their user id may be redacted by the
+			// masking policy.
+			received := 0
+			for _, response := range responses {
+				if response != nil && response.MessageId != nil {
+					p.inFlight.track(response)
+					results <- response
+					received++
+				}
+			}
+
+			if received > 0 {
 				emptyResponseCount = 0     // Reset the empty response counter
 				waitTime = initialWaitTime // Reset the wait time
 			} else {
@@ -70,15 +93,24 @@ func (p *transformer) Worker(ctx context.Context, id int, results chan<- *model.
 					lm = log.Message{Level: "INFO", Msg: fmt.Sprintf("Worker %d: Waiting for %v due to consecutive empty responses", id, waitTime)}
 					p.logger.Log(&lm)
 
-					time.Sleep(waitTime)        // Wait for the specified time before retrying
-					waitTime += initialWaitTime // Increase the wait time linearly
+					// Wait for the specified time before retrying unless the worker is stopped meanwhile
+					select {
+					case <-ctx.Done():
+					case <-time.After(waitTime):
+					}
+
+					// Increase the wait time linearly
+					waitTime += initialWaitTime
+					if waitTime > maxEmptyResponseWait {
+						waitTime = maxEmptyResponseWait
+					}
 				}
 
-				if emptyResponseCount >= maxConsecutiveEmptyResponses {
-					lm = log.Message{Level: "INFO", Msg: fmt.Sprintf("Worker %d: Reached max consecutive empty responses, canceling context", id)}
+				if maxConsecutiveEmptyResponses > 0 && emptyResponseCount >= maxConsecutiveEmptyResponses {
+					lm = log.Message{Level: "INFO", Msg: fmt.Sprintf("Worker %d: Reached max consecutive empty responses, stopping", id)}
 					p.logger.Log(&lm)
 
-					ctx.Done() // Cancel the context if the maximum consecutive empty responses are reached
+					// The pipeline shuts down once all the workers have stopped
 					return
 				}
 			}
@@ -86,34 +118,354 @@ func (p *transformer) Worker(ctx context.Context, id int, results chan<- *model.
 	}
 }
 
-func (p *transformer) ProcessDataFromWorker(ctx context.Context, results chan *model.Response) {
+// defaultBatchFlushInterval is the maximum age of a partial batch when BATCH_FLUSH_INTERVAL is not set.
+const defaultBatchFlushInterval = 30 * time.Second
+
+// ProcessDataFromWorker collects the responses sent by the workers into batches and loads them into the database.
+// A batch is flushed once it reaches BATCH_SIZE responses or once its first response is older than
+// BATCH_FLUSH_INTERVAL, whichever comes first. The messages of a batch are no longer extended by the Heartbeat once it
+// is flushed. It drains results until the channel is closed, once all the workers have stopped, then flushes the
+// final batch and releases the messages left on the queue so that another consumer receives them right away. An error is returned when messages of the final batch were
+// neither loaded nor dead-lettered and acknowledged. ctx bounds the database and SQS calls made while flushing. The
+// messages of a FIFO message group are loaded in sequence order, see flush.
+func (p *transformer) ProcessDataFromWorker(ctx context.Context, results <-chan *model.Response) error {
 	batchSize, _ := strconv.Atoi(os.Getenv("BATCH_SIZE"))
+	flushInterval, err := time.ParseDuration(os.Getenv("BATCH_FLUSH_INTERVAL"))
+	if err != nil || flushInterval <= 0 {
+		flushInterval = defaultBatchFlushInterval
+	}
 
 	//TODO: not required pointer to model.Response
 	var batch []*model.Response
+	var batchStartedAt time.Time
+	held := make(heldGroups)
+
+	// The flush timer is armed when the first response of a batch arrives, flushC is nil while the batch is empty.
+	flushTimer := time.NewTimer(flushInterval)
+	flushTimer.Stop()
+	var flushC <-chan time.Time
+
+	flushBatch := func(reason string) ([]*model.Response, error) {
+		stopTimer(flushTimer)
+		flushC = nil
+
+		lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Flushing batch of %d messages aged %v on %v (batch size %d, flush interval %v).", len(batch), time.Since(batchStartedAt).Round(time.Millisecond), reason, batchSize, flushInterval)}
+		p.logger.Log(&lm)
+
+		left, err := p.flush(ctx, batch, held)
+		p.inFlight.untrack(batch)
+		batch = batch[:0] // Reset batch
+
+		return left, err
+	}
+
 	for {
 		select {
-		case response := <-results:
+		case response, ok := <-results:
+			if !ok {
+				// All the workers have stopped, insert any remaining items before shutting down
+				if len(batch) == 0 {
+					return nil
+				}
+
+				left, err := flushBatch("shutdown")
+				if len(left) > 0 {
+					p.changeVisibility(ctx, left, 0)
+				}
+
+				return err
+			}
+
+			if len(batch) == 0 {
+				batchStartedAt = time.Now()
+				flushTimer.Reset(flushInterval)
+				flushC = flushTimer.C
+			}
+
 			batch = append(batch, response)
 			if len(batch) >= batchSize {
-				err := p.loader.BatchInsert(ctx, batch)
-				if err != nil {
-					lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error inserting batch: %v", err.Error())}
-					p.logger.Log(&lm)
+				_, _ = flushBatch("size")
+			}
+		case <-flushC:
+			_, _ = flushBatch("age")
+		}
+	}
+}
+
+// stopTimer stops the timer and drains its channel when it fired already. With the timers of go 1.21, which this
+// module declares, a tick sent before Stop stays in the channel and would be received once the timer is Reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// Heartbeat extends, every half visibilityTimeout, the visibility of the messages in flight, from the moment a worker
+// receives them until their batch is flushed, including while they wait in the results channel and while their batch
+// is being loaded, so that a slow batch is not redelivered to another consumer. It runs until ctx is cancelled, which
+// must not happen before ProcessDataFromWorker returned.
+func (p *transformer) Heartbeat(ctx context.Context, visibilityTimeout int) {
+	if visibilityTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(visibilityTimeout) * time.Second / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.inFlight.extend(func(responses []*model.Response) {
+				p.changeVisibility(ctx, responses, visibilityTimeout)
+			})
+		}
+	}
+}
+
+// Release releases the messages in flight, with a visibility timeout of 0, so that another consumer receives them
+// right away rather than once their visibility timeout expires. It is called when the pipeline is stopped before
+// their batch is flushed, e.g. on the shutdown deadline, and they are no longer extended by the Heartbeat.
+func (p *transformer) Release(ctx context.Context) {
+	responses := p.inFlight.drain()
+	if len(responses) > 0 {
+		p.changeVisibility(ctx, responses, 0)
+	}
+}
+
+// changeVisibility sets the visibility timeout of the messages of the responses, extending it while they are in flight
+// or releasing them with a timeout of 0. Failures are logged, the messages then keep their current visibility.
+func (p *transformer) changeVisibility(ctx context.Context, responses []*model.Response, visibilityTimeout int) {
+	err := p.extractor.ChangeMessageVisibilityBatch(ctx, responses, visibilityTimeout)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error changing the visibility of %d messages to %ds: %v", len(responses), visibilityTimeout, err.Error())}
+		p.logger.Log(&lm)
+
+		return
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Changed the visibility of %d messages to %ds.", len(responses), visibilityTimeout)}
+	p.logger.Log(&lm)
+}
+
+// minBisectSize is the size under which a failing batch is no longer split but inserted row by row.
+const minBisectSize = 4
+
+// flush loads the batch into the database and acknowledges its messages on SQS once they are committed. Rows that
+// are rejected by the database are dead-lettered and acknowledged as well, while rows that failed for a transient
+// reason, or whose dead letter cannot be stored, are left on the queue so that they are redelivered. An error is
+// returned when messages of the batch were left on the queue, they are returned along with it. Messages of erased
+// users are skipped by the loader and acknowledged. The messages of a FIFO message group are loaded in sequence order, and
+// once one of them is left on the queue the following ones are held, in this batch and the next ones, until the
+// group is redelivered.
+func (p *transformer) flush(ctx context.Context, batch []*model.Response, held heldGroups) (left []*model.Response, err error) {
+	defer func() {
+		for _, response := range left {
+			held.hold(response)
+		}
+	}()
+
+	orderGroups(batch)
 
+	rowErrors := p.load(ctx, batch, held)
+
+	failed := make(map[*model.Response]bool, len(rowErrors))
+	var letters []*model.DeadLetter
+	for _, rowErr := range rowErrors {
+		failed[rowErr.Response] = true
+
+		if !rowErr.Retryable {
+			letters = append(letters, model.NewDeadLetter(rowErr.Response.MessageId, rowErr.Response.RequestId, rowErr.Response.RawBody, rowErr.Response.SentAt, model.StageLoad, rowErr.Err))
+		}
+	}
+
+	acknowledged := make([]*model.Response, 0, len(batch))
+	for _, response := range batch {
+		if !failed[response] {
+			acknowledged = append(acknowledged, response)
+		}
+	}
+
+	if len(letters) > 0 {
+		err := p.deadLetter.Store(ctx, letters)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error dead-lettering %d rejected messages, left for redelivery: %v", len(letters), err.Error())}
+			p.logger.Log(&lm)
+		} else {
+			for _, rowErr := range rowErrors {
+				if !rowErr.Retryable {
+					acknowledged = append(acknowledged, rowErr.Response)
 				}
-				batch = batch[:0] // Reset batch
 			}
-		case <-ctx.Done():
-			// Insert any remaining items before shutting down
-			if len(batch) > 0 {
-				err := p.loader.BatchInsert(ctx, batch)
-				if err != nil {
-					lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error inserting final batch: %v", err.Error())}
-					p.logger.Log(&lm)
+		}
+	}
+
+	if len(rowErrors) > 0 {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Loaded %d of %d messages of the batch, %d rejected", len(batch)-len(rowErrors), len(batch), len(letters))}
+		p.logger.Log(&lm)
+	}
+
+	// The messages that were not acknowledged, all of them when they cannot be deleted, are left on the queue.
+	err = p.extractor.DeleteMessageBatch(ctx, acknowledged)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Error acknowledging batch: %v", err.Error())}
+		p.logger.Log(&lm)
+
+		return append([]*model.Response(nil), batch...), err
+	}
+
+	if len(acknowledged) < len(batch) {
+		isAcknowledged := make(map[*model.Response]bool, len(acknowledged))
+		for _, response := range acknowledged {
+			isAcknowledged[response] = true
+		}
+
+		for _, response := range batch {
+			if !isAcknowledged[response] {
+				left = append(left, response)
+			}
+		}
+
+		return left, fmt.Errorf("%d of %d messages of the batch left on the queue", len(left), len(batch))
+	}
+
+	return nil, nil
+}
+
+// load inserts the batch and, when the database rejects it because of the data of a row, splits it in halves that
+// are loaded separately until the batches are small enough to be inserted row by row. This way only the offending
+// rows are rejected and the rest of the batch is committed. The errors of the rows that were not inserted are returned.
+// Rows of the FIFO message groups that are held are not inserted, the groups of the rows that failed for a transient
+// reason are held.
+func (p *transformer) load(ctx context.Context, batch []*model.Response, held heldGroups) []model.RowError {
+	batch, rowErrors := held.split(batch)
+	if len(batch) == 0 {
+		return rowErrors
+	}
+
+	err := p.loader.BatchInsert(ctx, batch)
+	if err == nil {
+		return rowErrors
+	}
+
+	// The whole batch is retried later when the failure is not caused by its rows.
+	if !isDataError(err) {
+		for _, response := range batch {
+			rowErrors = append(rowErrors, model.RowError{Response: response, Err: err, Retryable: true})
+			held.hold(response)
+		}
+
+		return rowErrors
+	}
+
+	if len(batch) <= minBisectSize {
+		// Rows are inserted one at a time so that a row failing for a transient reason holds the following rows of its
+		// group.
+		for _, response := range batch {
+			if held.holds(response) {
+				rowErrors = append(rowErrors, model.RowError{Response: response, Err: errGroupHeld, Retryable: true})
+				continue
+			}
+
+			for _, rowErr := range p.loader.SequentialInsert(ctx, []*model.Response{response}) {
+				rowErrors = append(rowErrors, rowErr)
+				if rowErr.Retryable {
+					held.hold(response)
 				}
 			}
-			return
 		}
+
+		return rowErrors
+	}
+
+	mid := len(batch) / 2
+	rowErrors = append(rowErrors, p.load(ctx, batch[:mid], held)...)
+
+	return append(rowErrors, p.load(ctx, batch[mid:], held)...)
+}
+
+// Replay feeds the pending dead letters through the pipeline again, batchSize records at a time. Records that are
+// loaded are marked as replayed, the ones failing again stay in the dead letter with their attempt count incremented.
+func (p *transformer) Replay(ctx context.Context, batchSize int) (int, int, error) {
+	var replayed, failedCount int
+	var afterId int64
+
+	for {
+		letters, err := p.deadLetter.Pending(ctx, afterId, batchSize)
+		if err != nil {
+			return replayed, failedCount, err
+		}
+
+		if len(letters) == 0 {
+			return replayed, failedCount, nil
+		}
+
+		afterId = letters[len(letters)-1].Id
+
+		masker, err := p.masker.WithDataKey(ctx)
+		if err != nil {
+			return replayed, failedCount, err
+		}
+
+		// Transform the raw bodies again, records failing a stage are dead-lettered with that stage.
+		var batch []*model.Response
+		var rejected []*model.DeadLetter
+		var messageIds []string
+		for _, letter := range letters {
+			response, err := p.extractor.Transform(ctx, masker, letter.RequestId, letter.Message())
+			if errors.Is(err, model.ErrDataKeyShredded) {
+				// The user was erased, the letter is marked as replayed without being loaded.
+				messageIds = append(messageIds, stringValue(letter.MessageId))
+				continue
+			}
+
+			if err != nil {
+				var stageErr *model.StageError
+				if !errors.As(err, &stageErr) {
+					stageErr = &model.StageError{Stage: letter.Stage, Err: err}
+				}
+
+				rejected = append(rejected, model.NewDeadLetter(letter.MessageId, letter.RequestId, letter.RawBody, letter.SentAt, stageErr.Stage, stageErr.Err))
+				continue
+			}
+
+			batch = append(batch, response)
+		}
+
+		// Load the batch, rows that are rejected again stay in the dead letter and the ones of erased users are
+		// marked as replayed without being loaded.
+		failed := make(map[*model.Response]bool)
+		for _, rowErr := range p.load(ctx, batch, make(heldGroups)) {
+			failed[rowErr.Response] = true
+			rejected = append(rejected, model.NewDeadLetter(rowErr.Response.MessageId, rowErr.Response.RequestId, rowErr.Response.RawBody, rowErr.Response.SentAt, model.StageLoad, rowErr.Err))
+		}
+
+		for _, response := range batch {
+			if !failed[response] {
+				messageIds = append(messageIds, stringValue(response.MessageId))
+			}
+		}
+
+		err = p.deadLetter.MarkReplayed(ctx, messageIds)
+		if err != nil {
+			return replayed, failedCount, err
+		}
+
+		if len(rejected) > 0 {
+			err = p.deadLetter.Store(ctx, rejected)
+			if err != nil {
+				return replayed, failedCount, err
+			}
+		}
+
+		replayed += len(messageIds)
+		failedCount += len(rejected)
+
+		lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Replayed %d dead letters, %d failed again.", len(messageIds), len(rejected))}
+		p.logger.Log(&lm)
 	}
 }
@@ -0,0 +1,375 @@
+package etl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// visibilityChange is a call to ChangeMessageVisibilityBatch recorded by the fakeExtractor.
+type visibilityChange struct {
+	messageIds        []string
+	visibilityTimeout int
+}
+
+// fakeExtractor records the messages acknowledged and the visibility changes, it receives no message.
+type fakeExtractor struct {
+	mu           sync.Mutex
+	deleted      []string
+	visibilities chan visibilityChange
+}
+
+func newFakeExtractor() *fakeExtractor {
+	return &fakeExtractor{visibilities: make(chan visibilityChange, 100)}
+}
+
+func (f *fakeExtractor) FetchDataFromSQS(ctx context.Context) ([]*model.Response, error) {
+	return nil, nil
+}
+
+func (f *fakeExtractor) Transform(ctx context.Context, masker model.Masker, requestId *string, message *model.Message) (*model.Response, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeExtractor) DeleteMessageBatch(ctx context.Context, responses []*model.Response) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deleted = append(f.deleted, messageIdsOf(responses)...)
+
+	return nil
+}
+
+func (f *fakeExtractor) ChangeMessageVisibilityBatch(ctx context.Context, responses []*model.Response, visibilityTimeout int) error {
+	f.visibilities <- visibilityChange{messageIds: messageIdsOf(responses), visibilityTimeout: visibilityTimeout}
+
+	return nil
+}
+
+func (f *fakeExtractor) VisibilityTimeout(ctx context.Context) (int, error) {
+	return 30, nil
+}
+
+// fakeLoader inserts the rows in memory and rejects the rows of the poison messages with a data exception, like
+// postgres does for an invalid value. Every batch inserted is sent to batches. When hung, batch inserts block until
+// their ctx is cancelled, like on a database that stopped responding.
+type fakeLoader struct {
+	mu       sync.Mutex
+	poison   map[string]bool
+	inserted []string
+	batches  chan []string
+	hung     bool
+}
+
+func newFakeLoader(poison ...string) *fakeLoader {
+	l := &fakeLoader{poison: make(map[string]bool), batches: make(chan []string, 100)}
+	for _, messageId := range poison {
+		l.poison[messageId] = true
+	}
+
+	return l
+}
+
+var errInvalidValue = &pq.Error{Code: "22P02", Message: "invalid input syntax"}
+
+func (l *fakeLoader) BatchInsert(ctx context.Context, responses []*model.Response) error {
+	messageIds := messageIdsOf(responses)
+	l.batches <- messageIds
+
+	if l.hung {
+		<-ctx.Done()
+
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, messageId := range messageIds {
+		if l.poison[messageId] {
+			return errInvalidValue
+		}
+	}
+
+	l.inserted = append(l.inserted, messageIds...)
+
+	return nil
+}
+
+func (l *fakeLoader) SequentialInsert(ctx context.Context, responses []*model.Response) []model.RowError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var rowErrors []model.RowError
+	for _, response := range responses {
+		if l.poison[*response.MessageId] {
+			rowErrors = append(rowErrors, model.RowError{Response: response, Err: errInvalidValue, Retryable: false})
+			continue
+		}
+
+		l.inserted = append(l.inserted, *response.MessageId)
+	}
+
+	return rowErrors
+}
+
+// fakeDeadLetter records the messages dead-lettered.
+type fakeDeadLetter struct {
+	mu     sync.Mutex
+	stored []string
+}
+
+func (d *fakeDeadLetter) Store(ctx context.Context, letters []*model.DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, letter := range letters {
+		d.stored = append(d.stored, *letter.MessageId)
+	}
+
+	return nil
+}
+
+func (d *fakeDeadLetter) Pending(ctx context.Context, afterId int64, limit int) ([]*model.DeadLetter, error) {
+	return nil, nil
+}
+
+func (d *fakeDeadLetter) MarkReplayed(ctx context.Context, messageIds []string) error {
+	return nil
+}
+
+func newTestProcessor(t *testing.T, extractor Extract, loader Loader, deadLetter DeadLetter) *transformer {
+	t.Helper()
+
+	logger, err := log.NewCustomLogger(filepath.Join(t.TempDir(), "logs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewProcessor(logger, new(sync.WaitGroup), extractor, loader, deadLetter, nil).(*transformer)
+}
+
+// testResponses returns n responses of messages m0 to m<n-1>.
+func testResponses(n int) []*model.Response {
+	responses := make([]*model.Response, 0, n)
+	for i := 0; i < n; i++ {
+		messageId := fmt.Sprintf("m%d", i)
+		responses = append(responses, &model.Response{MessageId: &messageId, ReceiptHandle: "handle-" + messageId})
+	}
+
+	return responses
+}
+
+// messageIdsOf returns the message ids of the responses, sorted.
+func messageIdsOf(responses []*model.Response) []string {
+	messageIds := make([]string, 0, len(responses))
+	for _, response := range responses {
+		messageIds = append(messageIds, *response.MessageId)
+	}
+
+	sort.Strings(messageIds)
+
+	return messageIds
+}
+
+// receive returns the next value of c, failing the test when none is sent within a few seconds.
+func receive[T any](t *testing.T, c <-chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	var zero T
+
+	return zero
+}
+
+func TestStopTimerDrainsTick(t *testing.T) {
+	timer := time.NewTimer(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	stopTimer(timer)
+	timer.Reset(time.Hour)
+
+	select {
+	case <-timer.C:
+		t.Fatal("received a tick sent before the timer was stopped")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestProcessDataFromWorkerFlushesBySizeAndAge(t *testing.T) {
+	const flushInterval = 200 * time.Millisecond
+	t.Setenv("BATCH_SIZE", "2")
+	t.Setenv("BATCH_FLUSH_INTERVAL", flushInterval.String())
+
+	extractor, loader := newFakeExtractor(), newFakeLoader()
+	p := newTestProcessor(t, extractor, loader, &fakeDeadLetter{})
+
+	results := make(chan *model.Response)
+	processed := make(chan error, 1)
+	go func() {
+		processed <- p.ProcessDataFromWorker(context.Background(), results)
+	}()
+
+	responses := testResponses(3)
+	results <- responses[0]
+	results <- responses[1]
+
+	batch := receive(t, loader.batches)
+	if !reflect.DeepEqual(batch, []string{"m0", "m1"}) {
+		t.Fatalf("batch flushed on size %v, want [m0 m1]", batch)
+	}
+
+	// The timer armed for the first batch must not flush the next one early.
+	time.Sleep(flushInterval)
+
+	sentAt := time.Now()
+	results <- responses[2]
+
+	batch = receive(t, loader.batches)
+	if elapsed := time.Since(sentAt); !reflect.DeepEqual(batch, []string{"m2"}) || elapsed < flushInterval {
+		t.Fatalf("batch %v flushed on age after %v, want [m2] after %v", batch, elapsed, flushInterval)
+	}
+
+	close(results)
+
+	err := receive(t, processed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(extractor.deleted, []string{"m0", "m1", "m2"}) {
+		t.Errorf("acknowledged %v, want [m0 m1 m2]", extractor.deleted)
+	}
+}
+
+func TestFlushDeadLettersPoisonRow(t *testing.T) {
+	extractor, loader, deadLetter := newFakeExtractor(), newFakeLoader("m3"), &fakeDeadLetter{}
+	p := newTestProcessor(t, extractor, loader, deadLetter)
+
+	batch := testResponses(10)
+
+	left, err := p.flush(context.Background(), batch, make(heldGroups))
+	if err != nil || len(left) > 0 {
+		t.Fatalf("flush left %v on the queue: %v", messageIdsOf(left), err)
+	}
+
+	// The batch is split in halves down to minBisectSize rows, which are inserted one by one.
+	close(loader.batches)
+	var batches [][]string
+	for inserted := range loader.batches {
+		batches = append(batches, inserted)
+	}
+
+	want := [][]string{messageIdsOf(batch), {"m0", "m1", "m2", "m3", "m4"}, {"m0", "m1"}, {"m2", "m3", "m4"}, {"m5", "m6", "m7", "m8", "m9"}}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("batch inserts %v, want %v", batches, want)
+	}
+
+	if !reflect.DeepEqual(deadLetter.stored, []string{"m3"}) {
+		t.Errorf("dead-lettered %v, want [m3]", deadLetter.stored)
+	}
+
+	sort.Strings(loader.inserted)
+	if want := []string{"m0", "m1", "m2", "m4", "m5", "m6", "m7", "m8", "m9"}; !reflect.DeepEqual(loader.inserted, want) {
+		t.Errorf("inserted %v, want %v", loader.inserted, want)
+	}
+
+	// The poison row is acknowledged once dead-lettered, along with the rows inserted.
+	sort.Strings(extractor.deleted)
+	if want := messageIdsOf(batch); !reflect.DeepEqual(extractor.deleted, want) {
+		t.Errorf("acknowledged %v, want %v", extractor.deleted, want)
+	}
+}
+
+func TestReleaseInFlightOnShutdownDeadline(t *testing.T) {
+	t.Setenv("BATCH_SIZE", "2")
+
+	extractor, loader := newFakeExtractor(), newFakeLoader()
+	loader.hung = true
+	p := newTestProcessor(t, extractor, loader, &fakeDeadLetter{})
+
+	// m0 and m1 are flushed on a hung database while m2 waits in the results channel.
+	results := make(chan *model.Response, 3)
+	for _, response := range testResponses(3) {
+		p.inFlight.track(response)
+		results <- response
+	}
+
+	flushCtx, cancelFlush := context.WithCancel(context.Background())
+	processed := make(chan error, 1)
+	go func() {
+		processed <- p.ProcessDataFromWorker(flushCtx, results)
+	}()
+
+	receive(t, loader.batches)
+
+	// The shutdown deadline expired: the messages in flight are released, then the flush is cancelled.
+	p.Release(context.Background())
+	cancelFlush()
+	close(results)
+
+	change := receive(t, extractor.visibilities)
+	if want := (visibilityChange{messageIds: []string{"m0", "m1", "m2"}}); !reflect.DeepEqual(change, want) {
+		t.Errorf("visibility change %v, want %v", change, want)
+	}
+
+	receive(t, processed)
+
+	// The messages released are no longer extended by the heartbeat.
+	p.inFlight.extend(func(responses []*model.Response) {
+		t.Errorf("extended %v after the release", messageIdsOf(responses))
+	})
+}
+
+func TestHeartbeatExtendsInFlight(t *testing.T) {
+	extractor := newFakeExtractor()
+	p := newTestProcessor(t, extractor, newFakeLoader(), &fakeDeadLetter{})
+
+	responses := testResponses(2)
+	for _, response := range responses {
+		p.inFlight.track(response)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A visibility timeout of 1s extends the messages every 500ms.
+	go p.Heartbeat(ctx, 1)
+
+	change := receive(t, extractor.visibilities)
+	if want := (visibilityChange{messageIds: []string{"m0", "m1"}, visibilityTimeout: 1}); !reflect.DeepEqual(change, want) {
+		t.Fatalf("visibility change %v, want %v", change, want)
+	}
+
+	// The messages of a flushed batch are no longer extended.
+	p.inFlight.untrack(responses[:1])
+
+	change = receive(t, extractor.visibilities)
+	if want := (visibilityChange{messageIds: []string{"m1"}, visibilityTimeout: 1}); !reflect.DeepEqual(change, want) {
+		t.Fatalf("visibility change %v, want %v", change, want)
+	}
+
+	p.inFlight.untrack(responses[1:])
+
+	select {
+	case change = <-extractor.visibilities:
+		t.Errorf("visibility change %v once no message is in flight", change)
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,49 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+)
+
+type quarantine struct {
+	logger *log.CustomLogger
+	dbConn *sql.DB
+}
+
+// NewQuarantine creates a new instance of the Quarantine store backed by the user_logins_quarantine table.
+func NewQuarantine(logger *log.CustomLogger, dbConn *sql.DB) Quarantine {
+	return &quarantine{
+		logger: logger,
+		dbConn: dbConn,
+	}
+}
+
+// Store persists the raw payload of a corrupted or unparsable message together with the reason it was quarantined.
+func (q *quarantine) Store(ctx context.Context, message *model.QuarantinedMessage) error {
+	stmt := "INSERT INTO user_logins_quarantine (message_id, request_id, md5_of_body, raw_payload, reason, error_message, quarantined_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+
+	_, err := q.dbConn.ExecContext(ctx, stmt, message.MessageId, message.RequestId, message.MD5OfBody, message.RawPayload, message.Reason, message.ErrorMessage, message.QuarantinedAt)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to quarantine message with error : %v", err.Error())}
+		q.logger.Log(&lm)
+
+		return err
+	}
+
+	lm := log.Message{Level: "WARN", Msg: fmt.Sprintf("Quarantined message %v with reason %v.", stringValue(message.MessageId), message.Reason)}
+	q.logger.Log(&lm)
+
+	return nil
+}
+
+// stringValue returns the value of a nullable string or an empty string when it is nil.
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
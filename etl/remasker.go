@@ -0,0 +1,217 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"time"
+)
+
+type remasker struct {
+	logger *log.CustomLogger
+	dbConn *sql.DB
+	masker model.Masker
+	policy *model.MaskingPolicy
+}
+
+// NewRemasker creates a new instance of the Remasker that rewrites masked values of user_logins with the current
+// format of the masker, under a new data key per batch or under the data key of their user when the policy scopes keys
+// to users. Only the fields encrypted by the policy are remasked.
+func NewRemasker(logger *log.CustomLogger, dbConn *sql.DB, masker model.Masker, policy *model.MaskingPolicy) Remasker {
+	return &remasker{
+		logger: logger,
+		dbConn: dbConn,
+		masker: masker,
+		policy: policy,
+	}
+}
+
+// Remask walks user_logins batchSize rows at a time and rewrites the masked values that are not in the current
+// format, filling in missing blind indexes. Every batch is rewritten in its own short transaction, followed by a
+// pause, so that readers are never blocked for long and the job can be stopped and resumed at any time. The data keys
+// are then rewrapped with the active master key, the job only succeeds once none is left under a retired one.
+func (r *remasker) Remask(ctx context.Context, batchSize int, pause time.Duration) (int, error) {
+	var remasked int
+	var afterId int64
+
+	for {
+		lastId, count, err := r.remaskBatch(ctx, afterId, batchSize)
+		if err != nil {
+			return remasked, err
+		}
+
+		if lastId == afterId {
+			break
+		}
+
+		afterId = lastId
+		remasked += count
+
+		lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Remasked %d rows up to id %d.", count, lastId)}
+		r.logger.Log(&lm)
+
+		select {
+		case <-ctx.Done():
+			return remasked, ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+
+	rewrapped, err := r.masker.RewrapDataKeys(ctx, batchSize)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Rewrapping data keys failed after %d keys with error : %v", rewrapped, err.Error())}
+		r.logger.Log(&lm)
+
+		return remasked, err
+	}
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("Rewrapped %d data keys with the active master key.", rewrapped)}
+	r.logger.Log(&lm)
+
+	return remasked, nil
+}
+
+// remaskBatch rewrites the rows of the batch following afterId and returns the id of its last row along with the
+// number of rows rewritten.
+func (r *remasker) remaskBatch(ctx context.Context, afterId int64, batchSize int) (int64, int, error) {
+	tx, err := r.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return afterId, 0, err
+	}
+
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, user_id_index, masked_ip, ip_index, masked_device_id, device_id_index FROM user_logins WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE", afterId, batchSize)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to fetch rows to remask with error : %v", err.Error())}
+		r.logger.Log(&lm)
+
+		return afterId, 0, err
+	}
+
+	type row struct {
+		id          int64
+		userIDIndex *string
+		ip          maskedField
+		deviceID    maskedField
+	}
+
+	var batch []row
+	for rows.Next() {
+		var rw row
+
+		err = rows.Scan(&rw.id, &rw.userIDIndex, &rw.ip.masked, &rw.ip.index, &rw.deviceID.masked, &rw.deviceID.index)
+		if err != nil {
+			rows.Close()
+
+			return afterId, 0, err
+		}
+
+		batch = append(batch, rw)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return afterId, 0, err
+	}
+
+	if len(batch) == 0 {
+		return afterId, 0, nil
+	}
+
+	// The rows of the batch are remasked with a data key of their own, unless they are remasked with the data key of
+	// their user. Rows loaded before user ids had a blind index keep the key of the batch.
+	batchMasker, err := r.masker.WithDataKey(ctx)
+	if err != nil {
+		return afterId, 0, err
+	}
+
+	var count int
+	for _, rw := range batch {
+		masker := batchMasker
+		if r.policy.UserKeys() && rw.userIDIndex != nil {
+			masker, err = r.masker.ForUser(ctx, *rw.userIDIndex)
+			if err != nil {
+				return afterId, 0, fmt.Errorf("loading user data key of row %d: %w", rw.id, err)
+			}
+		}
+
+		ip, ipChanged, err := r.remask(ctx, masker, model.FieldIP, rw.ip)
+		if err != nil {
+			return afterId, 0, fmt.Errorf("remasking ip of row %d: %w", rw.id, err)
+		}
+
+		deviceID, deviceIDChanged, err := r.remask(ctx, masker, model.FieldDeviceID, rw.deviceID)
+		if err != nil {
+			return afterId, 0, fmt.Errorf("remasking device_id of row %d: %w", rw.id, err)
+		}
+
+		if !ipChanged && !deviceIDChanged {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE user_logins SET masked_ip = $1, ip_index = $2, masked_device_id = $3, device_id_index = $4 WHERE id = $5",
+			ip.masked, ip.index, deviceID.masked, deviceID.index, rw.id)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Failed to remask row %d with error : %v", rw.id, err.Error())}
+			r.logger.Log(&lm)
+
+			return afterId, 0, err
+		}
+
+		count++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return afterId, 0, err
+	}
+
+	return batch[len(batch)-1].id, count, nil
+}
+
+// maskedField is a masked value along with its blind index.
+type maskedField struct {
+	masked *string
+	index  *string
+}
+
+// remask unmasks and masks the value again with the masker of the batch when it is not in the current format, and
+// fills in its blind index when it is missing. Values of fields the policy does not encrypt are left as they are, as
+// are the values of erased users whose data key was shredded.
+func (r *remasker) remask(ctx context.Context, masker model.Masker, field string, value maskedField) (maskedField, bool, error) {
+	if r.policy.Action(field) != model.ActionEncrypt {
+		return value, false, nil
+	}
+
+	needsRemask := value.masked != nil && masker.NeedsRemask(*value.masked)
+	if value.masked == nil || (!needsRemask && value.index != nil) {
+		return value, false, nil
+	}
+
+	plaintext, err := masker.Unmask(ctx, field, *value.masked)
+	if errors.Is(err, model.ErrDataKeyNotFound) {
+		return value, false, nil
+	}
+
+	if err != nil {
+		return value, false, err
+	}
+
+	index := masker.BlindIndex(field, plaintext)
+	value.index = &index
+
+	if needsRemask {
+		remasked, err := masker.Mask(ctx, field, plaintext)
+		if err != nil {
+			return value, false, err
+		}
+
+		value.masked = &remasked
+	}
+
+	return value, true, nil
+}
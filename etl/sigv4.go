@@ -0,0 +1,202 @@
+package etl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// sigV4Algorithm is the signing algorithm of AWS Signature Version 4.
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	// sigV4TimeFormat and sigV4DateFormat are the formats of the X-Amz-Date header and of the date of the scope.
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+	// sqsSigningName is the name SQS is signed for.
+	sqsSigningName = "sqs"
+)
+
+// AWSCredentials are the credentials requests to SQS are signed with. SessionToken is only set for temporary
+// credentials.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// sigV4Signer signs requests with AWS Signature Version 4 for a service in a region.
+type sigV4Signer struct {
+	credentials AWSCredentials
+	region      string
+	service     string
+}
+
+func newSigV4Signer(credentials AWSCredentials, region string, service string) (*sigV4Signer, error) {
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, errors.New("signing requires an access key id and a secret access key")
+	}
+
+	if region == "" {
+		return nil, errors.New("signing requires a region")
+	}
+
+	return &sigV4Signer{
+		credentials: credentials,
+		region:      region,
+		service:     service,
+	}, nil
+}
+
+// Sign adds the X-Amz-Date, X-Amz-Security-Token and Authorization headers to the request, whose body is given as
+// payload. The host and all the headers already set on the request are signed.
+func (s *sigV4Signer) Sign(req *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	if s.credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.credentials.SessionToken)
+	}
+
+	canonicalRequest, signedHeaders := s.canonicalRequest(req, payload)
+	scope, stringToSign := s.stringToSign(canonicalRequest, now)
+
+	req.Header.Set("Authorization", sigV4Algorithm+" Credential="+s.credentials.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+s.signature(stringToSign, now))
+}
+
+// stringToSign returns the credential scope of requests signed at now along with the string to sign of the canonical
+// request.
+func (s *sigV4Signer) stringToSign(canonicalRequest string, now time.Time) (string, string) {
+	scope := strings.Join([]string{now.Format(sigV4DateFormat), s.region, s.service, "aws4_request"}, "/")
+
+	return scope, strings.Join([]string{sigV4Algorithm, now.Format(sigV4TimeFormat), scope, hashHex([]byte(canonicalRequest))}, "\n")
+}
+
+// signature signs the string to sign with the key derived from the secret access key for the scope of now.
+func (s *sigV4Signer) signature(stringToSign string, now time.Time) string {
+	key := hmacSHA256([]byte("AWS4"+s.credentials.SecretAccessKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalRequest returns the canonical form of the request along with the list of its signed headers.
+func (s *sigV4Signer) canonicalRequest(req *http.Request, payload []byte) (string, string) {
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" {
+			continue
+		}
+
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+
+		headers[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		canonicalURI(path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hashHex(payload),
+	}, "\n"), signedHeaders
+}
+
+// canonicalURI encodes every segment of the already escaped path once more, as services other than S3 expect.
+func canonicalURI(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery returns the query parameters sorted by name and value, encoded with uriEncode.
+func canonicalQuery(query url.Values) string {
+	var params [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{uriEncode(name), uriEncode(value)})
+		}
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+
+		return params[i][1] < params[j][1]
+	})
+
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+
+	return strings.Join(encoded, "&")
+}
+
+// uriEncode percent-encodes every byte but the unreserved characters of RFC 3986.
+func uriEncode(value string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			encoded.WriteByte(c)
+		} else {
+			encoded.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+
+	return encoded.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,267 @@
+package etl
+
+import (
+	"context"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Credentials, region and service of the AWS Signature Version 4 test suite.
+var testSuiteCredentials = AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+const (
+	testSuiteRegion  = "us-east-1"
+	testSuiteService = "service"
+	testSuiteTime    = "20150830T123600Z"
+)
+
+func TestSigV4TestSuite(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		url              string
+		headers          map[string]string
+		body             string
+		canonicalRequest []string
+		stringToSign     []string
+		signature        string
+	}{
+		{
+			name:   "get-vanilla",
+			method: "GET",
+			url:    "https://example.amazonaws.com/",
+			canonicalRequest: []string{
+				"GET", "/", "", "host:example.amazonaws.com", "x-amz-date:20150830T123600Z", "", "host;x-amz-date",
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			},
+			stringToSign: []string{
+				"AWS4-HMAC-SHA256", "20150830T123600Z", "20150830/us-east-1/service/aws4_request",
+				"bb579772317eb040ac9ed261061d46c1f17a8133879d6129b6e1c25292927e63",
+			},
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "get-vanilla-query-order-key-case",
+			method: "GET",
+			url:    "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			canonicalRequest: []string{
+				"GET", "/", "Param1=value1&Param2=value2", "host:example.amazonaws.com", "x-amz-date:20150830T123600Z", "",
+				"host;x-amz-date", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			},
+			stringToSign: []string{
+				"AWS4-HMAC-SHA256", "20150830T123600Z", "20150830/us-east-1/service/aws4_request",
+				"816cd5b414d056048ba4f7c5386d6e0533120fb1fcfa93762cf0fc39e2cf19e0",
+			},
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:   "get-vanilla-query-order-value",
+			method: "GET",
+			url:    "https://example.amazonaws.com/?Param1=value2&Param1=value1",
+			canonicalRequest: []string{
+				"GET", "/", "Param1=value1&Param1=value2", "host:example.amazonaws.com", "x-amz-date:20150830T123600Z", "",
+				"host;x-amz-date", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			},
+			stringToSign: []string{
+				"AWS4-HMAC-SHA256", "20150830T123600Z", "20150830/us-east-1/service/aws4_request",
+				"c968629d70850097a2d8781c9bf7edcb988b04cac14cca9be4acc3595f884606",
+			},
+			signature: "5772eed61e12b33fae39ee5e7012498b51d56abc0abb7c60486157bd471c4694",
+		},
+		{
+			name:   "get-vanilla-query-unreserved",
+			method: "GET",
+			url: "https://example.amazonaws.com/?-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=" +
+				"-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+			canonicalRequest: []string{
+				"GET", "/",
+				"-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+				"host:example.amazonaws.com", "x-amz-date:20150830T123600Z", "", "host;x-amz-date",
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			},
+			stringToSign: []string{
+				"AWS4-HMAC-SHA256", "20150830T123600Z", "20150830/us-east-1/service/aws4_request",
+				"c30d4703d9f799439be92736156d47ccfb2d879ddf56f5befa6d1d6aab979177",
+			},
+			signature: "9c3e54bfcdf0b19771a7f523ee5669cdf59bc7cc0884027167c21bb143a40197",
+		},
+		{
+			name:   "post-vanilla",
+			method: "POST",
+			url:    "https://example.amazonaws.com/",
+			canonicalRequest: []string{
+				"POST", "/", "", "host:example.amazonaws.com", "x-amz-date:20150830T123600Z", "", "host;x-amz-date",
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			},
+			stringToSign: []string{
+				"AWS4-HMAC-SHA256", "20150830T123600Z", "20150830/us-east-1/service/aws4_request",
+				"553f88c9e4d10fc9e109e2aeb65f030801b70c2f6468faca261d401ae622fc87",
+			},
+			signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:    "post-x-www-form-urlencoded",
+			method:  "POST",
+			url:     "https://example.amazonaws.com/",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:    "Param1=value1",
+			canonicalRequest: []string{
+				"POST", "/", "", "content-type:application/x-www-form-urlencoded", "host:example.amazonaws.com",
+				"x-amz-date:20150830T123600Z", "", "content-type;host;x-amz-date",
+				"9095672bbd1f56dfc5b65f3e153adc8731a4a654192329106275f4c7b24d0b6e",
+			},
+			stringToSign: []string{
+				"AWS4-HMAC-SHA256", "20150830T123600Z", "20150830/us-east-1/service/aws4_request",
+				"42a5e5bb34198acb3e84da4f085bb7927f2bc277ca766e6d19c73c2154021281",
+			},
+			signature: "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+
+	signer, err := newSigV4Signer(testSuiteCredentials, testSuiteRegion, testSuiteService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now, _ := time.Parse(sigV4TimeFormat, testSuiteTime)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			req.Header = http.Header{}
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+
+			signer.Sign(req, []byte(tc.body), now)
+
+			canonicalRequest, signedHeaders := signer.canonicalRequest(req, []byte(tc.body))
+			if want := strings.Join(tc.canonicalRequest, "\n"); canonicalRequest != want {
+				t.Errorf("canonical request\n%q\nwant\n%q", canonicalRequest, want)
+			}
+
+			scope, stringToSign := signer.stringToSign(canonicalRequest, now)
+			if want := strings.Join(tc.stringToSign, "\n"); stringToSign != want {
+				t.Errorf("string to sign\n%q\nwant\n%q", stringToSign, want)
+			}
+
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature=" + tc.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// verifySigV4 recomputes the signature of a request received by a stub of SQS from the headers listed in its
+// Authorization header and reports whether it matches.
+func verifySigV4(r *http.Request, body []byte, credentials AWSCredentials, region string) bool {
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" "), ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+
+	now, err := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	if credential != credentials.AccessKeyID+"/"+now.Format(sigV4DateFormat)+"/"+region+"/"+sqsSigningName+"/aws4_request" {
+		return false
+	}
+
+	names := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(names) {
+		return false
+	}
+
+	var headers strings.Builder
+	for _, name := range names {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{r.Method, canonicalURI(r.URL.EscapedPath()), canonicalQuery(r.URL.Query()),
+		headers.String(), signedHeaders, hashHex(body)}, "\n")
+
+	signer := &sigV4Signer{credentials: credentials, region: region, service: sqsSigningName}
+	_, stringToSign := signer.stringToSign(canonicalRequest, now)
+
+	return signer.signature(stringToSign, now) == signature
+}
+
+func TestSignedRequestsVerify(t *testing.T) {
+	credentials := AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "example session token",
+	}
+
+	for _, protocol := range []string{SQSProtocolQuery, SQSProtocolJSON} {
+		t.Run(protocol, func(t *testing.T) {
+			var verified bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+
+				verified = verifySigV4(r, body, credentials, "eu-west-1") &&
+					strings.Contains(r.Header.Get("Authorization"), "x-amz-security-token")
+				if !verified {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+
+				if protocol == SQSProtocolJSON {
+					w.Header().Set("Content-Type", sqsJSONContentType)
+					_, _ = w.Write([]byte(`{}`))
+					return
+				}
+
+				_, _ = w.Write([]byte(`<PurgeQueueResponse></PurgeQueueResponse>`))
+			}))
+			defer server.Close()
+
+			logger, err := log.NewCustomLogger(filepath.Join(t.TempDir(), "logs"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ex, err := NewExtractor(logger, nil, nil, nil, nil, ExtractorConfig{
+				SQSEndpoint: server.URL + "/000000000000/login-queue?Action=ReceiveMessage",
+				Protocol:    protocol,
+				Region:      "eu-west-1",
+				Credentials: credentials,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ex.(*extractor).call(context.Background(), "PurgeQueue", url.Values{}, map[string]interface{}{})
+			if err != nil || !verified {
+				t.Fatalf("signed %v request was rejected: %v", protocol, err)
+			}
+		})
+	}
+}
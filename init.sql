@@ -1,11 +1,163 @@
 -- init.sql
 
 CREATE TABLE IF NOT EXISTS user_logins(
-    user_id varchar(128),
-    device_type varchar(32),
+    id bigserial PRIMARY KEY,
+    message_id varchar(128),
+    request_id varchar(128),
+    user_id varchar(256),
+    user_id_index varchar(64),
+    device_type varchar(256),
     masked_ip varchar(256),
+    ip_index varchar(64),
     masked_device_id varchar(256),
-    locale varchar(32),
-    app_version varchar(10),
-    create_date date
-);
\ No newline at end of file
+    device_id_index varchar(64),
+    locale varchar(256),
+    app_version varchar(256),
+    create_date date,
+    sent_timestamp timestamp,
+    approximate_receive_count int,
+    approximate_first_receive_timestamp timestamp,
+    loaded_at timestamp
+);
+
+-- Upgrade tables created before messages were loaded idempotently.
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS message_id varchar(128);
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS request_id varchar(128);
+CREATE UNIQUE INDEX IF NOT EXISTS user_logins_message_id_key ON user_logins (message_id);
+
+-- Upgrade tables created before masked values could be migrated in batches.
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS id bigserial PRIMARY KEY;
+
+-- Upgrade tables created before duplicates were detected through blind indexes, filled in by the remask command.
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS ip_index varchar(64);
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS device_id_index varchar(64);
+CREATE INDEX IF NOT EXISTS user_logins_blind_index_idx ON user_logins (ip_index, device_id_index);
+CREATE INDEX IF NOT EXISTS user_logins_device_id_index_idx ON user_logins (device_id_index);
+
+-- Upgrade tables created before masking policies, any field can hold an encrypted value.
+ALTER TABLE user_logins
+    ALTER COLUMN user_id TYPE varchar(256),
+    ALTER COLUMN device_type TYPE varchar(256),
+    ALTER COLUMN locale TYPE varchar(256),
+    ALTER COLUMN app_version TYPE varchar(256);
+
+-- Upgrade tables created before users could be erased, rows loaded before are matched on their plaintext user_id.
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS user_id_index varchar(64);
+CREATE INDEX IF NOT EXISTS user_logins_user_id_index_idx ON user_logins (user_id_index);
+
+-- Upgrade tables created before the time a login happened was told apart from the time it was loaded, create_date
+-- being the load date of the rows loaded before.
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS sent_timestamp timestamp;
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS approximate_receive_count int;
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS approximate_first_receive_timestamp timestamp;
+ALTER TABLE user_logins ADD COLUMN IF NOT EXISTS loaded_at timestamp;
+
+CREATE TABLE IF NOT EXISTS user_logins_quarantine(
+    id bigserial PRIMARY KEY,
+    message_id varchar(128),
+    request_id varchar(128),
+    md5_of_body varchar(32),
+    raw_payload text,
+    reason varchar(32),
+    error_message text,
+    quarantined_at timestamp
+);
+
+CREATE TABLE IF NOT EXISTS user_logins_dead_letter(
+    id bigserial PRIMARY KEY,
+    message_id varchar(128) UNIQUE,
+    request_id varchar(128),
+    raw_body text,
+    sent_timestamp timestamp,
+    stage varchar(16),
+    error_message text,
+    attempts int NOT NULL DEFAULT 1,
+    first_failed_at timestamp,
+    last_failed_at timestamp,
+    replayed_at timestamp
+);
+
+-- Upgrade tables created before dead letters kept the time their message was sent.
+ALTER TABLE user_logins_dead_letter ADD COLUMN IF NOT EXISTS sent_timestamp timestamp;
+
+CREATE TABLE IF NOT EXISTS encryption_data_keys(
+    id varchar(64) PRIMARY KEY,
+    master_key_id varchar(64) NOT NULL,
+    wrapped_key bytea,
+    created_at timestamp NOT NULL,
+    shredded_at timestamp
+);
+
+-- Upgrade tables created before shredded data keys were kept as tombstones, rows without a wrapped key.
+ALTER TABLE encryption_data_keys ALTER COLUMN wrapped_key DROP NOT NULL;
+ALTER TABLE encryption_data_keys ADD COLUMN IF NOT EXISTS shredded_at timestamp;
+
+-- Values swapped for surrogate tokens by the tokenize masking action, deleting an entry makes its value irrecoverable
+-- wherever its token is stored. The table is revoked from PUBLIC so that roles other than its owner, which the etl and
+-- the api connect as, only read it when granted pii_vault_access.
+CREATE TABLE IF NOT EXISTS pii_vault(
+    token varchar(64) PRIMARY KEY,
+    field varchar(32) NOT NULL,
+    value_index varchar(64) NOT NULL,
+    masked_value varchar(256) NOT NULL,
+    created_at timestamp NOT NULL,
+    UNIQUE (field, value_index)
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'pii_vault_access') THEN
+        CREATE ROLE pii_vault_access NOLOGIN;
+    END IF;
+END
+$$;
+
+REVOKE ALL ON pii_vault FROM PUBLIC;
+GRANT SELECT, INSERT, DELETE ON pii_vault TO pii_vault_access;
+
+-- Audit records of the right-to-be-forgotten erasures, redelivered messages of an erased user are not loaded again.
+CREATE TABLE IF NOT EXISTS user_logins_erasures(
+    id bigserial PRIMARY KEY,
+    user_id_index varchar(64) NOT NULL,
+    requested_by varchar(128) NOT NULL,
+    reason text,
+    requested_at timestamp NOT NULL,
+    logins_deleted bigint NOT NULL DEFAULT 0,
+    dead_letters_deleted bigint NOT NULL DEFAULT 0,
+    quarantined_deleted bigint NOT NULL DEFAULT 0,
+    mode varchar(16) NOT NULL DEFAULT 'delete',
+    logins_shredded bigint NOT NULL DEFAULT 0,
+    vault_entries_deleted bigint NOT NULL DEFAULT 0
+);
+
+-- Upgrade tables created before users could be erased by deleting their data key.
+ALTER TABLE user_logins_erasures ADD COLUMN IF NOT EXISTS mode varchar(16) NOT NULL DEFAULT 'delete';
+ALTER TABLE user_logins_erasures ADD COLUMN IF NOT EXISTS logins_shredded bigint NOT NULL DEFAULT 0;
+
+-- Upgrade tables created before erasures deleted the vault entries of the user.
+ALTER TABLE user_logins_erasures ADD COLUMN IF NOT EXISTS vault_entries_deleted bigint NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS user_logins_erasures_user_id_index_idx ON user_logins_erasures (user_id_index);
+
+-- Append-only audit trail of the logins returned unmasked by the API, updates and deletes are rejected by a trigger.
+CREATE TABLE IF NOT EXISTS decryption_audit(
+    id bigserial PRIMARY KEY,
+    caller varchar(128) NOT NULL,
+    remote_addr varchar(64) NOT NULL,
+    requested_at timestamp NOT NULL,
+    filter jsonb NOT NULL,
+    row_count integer NOT NULL,
+    login_ids bigint[] NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS decryption_audit_caller_idx ON decryption_audit (caller, requested_at);
+
+CREATE OR REPLACE FUNCTION decryption_audit_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'decryption_audit is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS decryption_audit_append_only ON decryption_audit;
+CREATE TRIGGER decryption_audit_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON decryption_audit
+    FOR EACH STATEMENT EXECUTE FUNCTION decryption_audit_append_only();
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/shivasaicharanruthala/dataops-takehome/log"
+	"github.com/shivasaicharanruthala/dataops-takehome/model"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serveKMS runs a local stand-in for a KMS: it holds the master keys of a key file and wraps and unwraps data keys
+// over HTTP for the pipeline and the API, so that the master keys never leave it. Every request must carry KMS_TOKEN
+// as a bearer token. It is meant for local development only and listens on localhost unless told otherwise.
+func serveKMS(logger *log.CustomLogger, args []string) {
+	flags := flag.NewFlagSet("kms-server", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8070", "address the KMS listens on")
+	keyFile := flags.String("key-file", os.Getenv("KMS_KEY_FILE"), "path of the JSON file holding the master keys")
+	_ = flags.Parse(args)
+
+	token := os.Getenv("KMS_TOKEN")
+	if token == "" {
+		lm := log.Message{Level: "ERROR", ErrorMessage: "KMS requires KMS_TOKEN to authenticate its clients"}
+		logger.Log(&lm)
+
+		return
+	}
+
+	keyring, err := model.LoadKeyFile(*keyFile)
+	if err != nil {
+		lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Loading master keys failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	provider := model.NewLocalKeyProvider(keyring)
+
+	router := mux.NewRouter().StrictSlash(true)
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			if !strings.HasPrefix(authorization, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) != 1 {
+				http.Error(w, "invalid KMS token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+	router.HandleFunc("/wrap", func(w http.ResponseWriter, r *http.Request) {
+		var req model.WrapKeyRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || len(req.Plaintext) == 0 {
+			http.Error(w, "invalid wrap request", http.StatusBadRequest)
+			return
+		}
+
+		keyID, ciphertext, err := provider.WrapKey(r.Context(), req.Plaintext)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Wrapping data key failed with error %v", err.Error())}
+			logger.Log(&lm)
+
+			http.Error(w, "wrapping data key failed", http.StatusInternalServerError)
+			return
+		}
+
+		writeKMSResponse(w, model.WrapKeyResponse{KeyID: keyID, Ciphertext: ciphertext})
+	}).Methods("POST")
+
+	router.HandleFunc("/unwrap", func(w http.ResponseWriter, r *http.Request) {
+		var req model.UnwrapKeyRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.KeyID == "" || len(req.Ciphertext) == 0 {
+			http.Error(w, "invalid unwrap request", http.StatusBadRequest)
+			return
+		}
+
+		plaintext, err := provider.UnwrapKey(r.Context(), req.KeyID, req.Ciphertext)
+		if err != nil {
+			lm := log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Unwrapping data key under master key %v failed with error %v", req.KeyID, err.Error())}
+			logger.Log(&lm)
+
+			http.Error(w, "unwrapping data key failed", http.StatusBadRequest)
+			return
+		}
+
+		writeKMSResponse(w, model.UnwrapKeyResponse{Plaintext: plaintext})
+	}).Methods("POST")
+
+	router.HandleFunc("/active-key", func(w http.ResponseWriter, r *http.Request) {
+		writeKMSResponse(w, model.ActiveKeyResponse{KeyID: keyring.ActiveKeyID})
+	}).Methods("POST")
+
+	lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("KMS starting to listen on %v with active master key %v", *addr, keyring.ActiveKeyID)}
+	logger.Log(&lm)
+
+	err = http.ListenAndServe(*addr, router)
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("KMS listening on %v failed with error %v", *addr, err.Error())}
+		logger.Log(&lm)
+	}
+}
+
+func writeKMSResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
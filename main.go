@@ -12,7 +12,7 @@ import (
 	"strconv"
 	"sync"
 	"syscall"
-	_ "time"
+	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -30,8 +30,30 @@ func main() {
 	// Retrieve the number of workers and batch size from environment variables and convert them to integers.
 	noOfWorkers, _ := strconv.Atoi(os.Getenv("NO_OF_WORKERS"))
 	batchSize, _ := strconv.Atoi(os.Getenv("BATCH_SIZE"))
+	maxNumberOfMessages, _ := strconv.Atoi(os.Getenv("SQS_MAX_NUMBER_OF_MESSAGES"))
+	waitTimeSeconds, _ := strconv.Atoi(os.Getenv("SQS_WAIT_TIME_SECONDS"))
+	visibilityTimeout, _ := strconv.Atoi(os.Getenv("SQS_VISIBILITY_TIMEOUT"))
 	sqsEndpoint := os.Getenv("SQS_ENDPOINT")
+	sqsProtocol := os.Getenv("SQS_PROTOCOL")
+	awsRegion := os.Getenv("AWS_REGION")
+	awsCredentials := etl.AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
 	encryptionKey := os.Getenv("ENCRYPTION_SECRET")
+	encryptionKeys := os.Getenv("ENCRYPTION_KEYS")
+	activeKeyID := os.Getenv("ENCRYPTION_ACTIVE_KEY_ID")
+	blindIndexSecret := os.Getenv("BLIND_INDEX_SECRET")
+	keyProvider := os.Getenv("KEY_PROVIDER")
+	keyFile := os.Getenv("KEY_FILE")
+	kmsEndpoint := os.Getenv("KMS_ENDPOINT")
+	kmsToken := os.Getenv("KMS_TOKEN")
+	maskingPolicyFile := os.Getenv("MASKING_POLICY_FILE")
+	shutdownTimeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || shutdownTimeout <= 0 {
+		shutdownTimeout = 30 * time.Second
+	}
 
 	// Initialize Logger
 	logger, err := log.NewCustomLogger("logs")
@@ -43,6 +65,13 @@ func main() {
 	lm := log.Message{Level: "INFO", Msg: "Logger initialized successfully"}
 	logger.Log(&lm)
 
+	// The KMS stand-in holds the master keys only, it needs neither the database nor SQS.
+	if len(os.Args) > 1 && os.Args[1] == "kms-server" {
+		serveKMS(logger, os.Args[2:])
+
+		return
+	}
+
 	// Initialize a new database connection.
 	db := database.New(logger)
 	dbConn, err := db.Open()
@@ -61,17 +90,121 @@ func main() {
 	var wg sync.WaitGroup
 	// Channel to collect results from workers
 	results := make(chan *model.Response, noOfWorkers*batchSize)
-	// Context to handle singling to go routines to terminate
-	ctx, cancel := context.WithCancel(context.Background())
+	// Context to handle singling to worker go routines to stop receiving messages
+	receiveCtx, stopReceiving := context.WithCancel(context.Background())
+	// Context bounding the database and SQS calls made while flushing batches, cancelled on the shutdown deadline
+	flushCtx, cancelFlush := context.WithCancel(context.Background())
+
+	// Initialize the masker used to encrypt PII fields. ENCRYPTION_SECRET and ENCRYPTION_KEYS hold the master keys of
+	// the env key provider, with the other providers they are only needed to unmask values written before envelope
+	// encryption.
+	var keyring *model.Keyring
+	if encryptionKey != "" || encryptionKeys != "" {
+		keyring, err = model.ParseKeyring(encryptionKey, encryptionKeys, activeKeyID)
+		if err != nil {
+			lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Initiating keyring failed with error %v", err.Error())}
+			logger.Log(&lm)
+
+			return
+		}
+	}
+
+	provider, err := model.NewKeyProvider(model.KeyProviderConfig{
+		Provider:    keyProvider,
+		KeyFile:     keyFile,
+		KMSEndpoint: kmsEndpoint,
+		KMSToken:    kmsToken,
+		Keyring:     keyring,
+	})
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Initiating key provider failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	masker, err := model.NewMasker(provider, database.NewDataKeyStore(logger, dbConn), database.NewVault(logger, dbConn), keyring, blindIndexSecret)
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Initiating masker failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	policy, err := model.LoadMaskingPolicy(maskingPolicyFile)
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Loading masking policy failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	// Drop the data keys shredded by other instances, e.g. the api-server erasing a user, from the cache of the masker.
+	err = db.Listen(database.DataKeyShreddedChannel, func(id string) {
+		if id == "" {
+			masker.ForgetDataKeys()
+		} else {
+			masker.ForgetDataKeys(id)
+		}
+	})
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Listening to shredded data keys failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
 
 	// Initialize the ETL components.
-	extractor := etl.NewExtractor(logger, sqsEndpoint, encryptionKey)
+	quarantine := etl.NewQuarantine(logger, dbConn)
+	deadLetter := etl.NewDeadLetter(logger, dbConn)
+	extractor, err := etl.NewExtractor(logger, quarantine, deadLetter, masker, policy, etl.ExtractorConfig{
+		SQSEndpoint:         sqsEndpoint,
+		Protocol:            sqsProtocol,
+		MaxNumberOfMessages: maxNumberOfMessages,
+		WaitTimeSeconds:     waitTimeSeconds,
+		VisibilityTimeout:   visibilityTimeout,
+		Region:              awsRegion,
+		Credentials:         awsCredentials,
+		StoreContext:        flushCtx,
+	})
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Initiating extractor failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
 	loader := etl.NewLoader(logger, dbConn)
-	processor := etl.NewProcessor(logger, &wg, extractor, loader)
+	if os.Getenv("LOADER_MODE") == "copy" {
+		loader = etl.NewCopyLoader(logger, dbConn)
+	}
+	eraser := etl.NewEraser(logger, dbConn, masker, policy)
+	processor := etl.NewProcessor(logger, &wg, extractor, loader, deadLetter, masker)
 
 	lm = log.Message{Level: "INFO", Msg: fmt.Sprintf("Extractor, Loader, Processor initilized sucessfully.")}
 	logger.Log(&lm)
 
+	// Run a one-off command instead of the pipeline when one is given, e.g. `dataops-takehome replay`.
+	if len(os.Args) > 1 {
+		runCommand(context.Background(), logger, dbConn, processor, etl.NewRemasker(logger, dbConn, masker, policy), eraser, os.Args[1], os.Args[2:])
+		stopReceiving()
+		cancelFlush()
+
+		return
+	}
+
+	// The visibility of the messages in flight is extended every half visibility timeout, the queue's own when
+	// SQS_VISIBILITY_TIMEOUT is not set, by a heartbeat running until the final batch is flushed.
+	visibilityTimeout, err = extractor.VisibilityTimeout(receiveCtx)
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Reading the visibility timeout of the queue failed with error %v", err.Error())}
+		logger.Log(&lm)
+
+		return
+	}
+
+	go processor.Heartbeat(flushCtx, visibilityTimeout)
+
 	// Start worker goroutines
 	for idx := 0; idx < noOfWorkers; idx++ {
 		wg.Add(1)
@@ -79,24 +212,71 @@ func main() {
 		lm = log.Message{Level: "INFO", Msg: fmt.Sprintf("Worker %v assigned to extract data.", idx)}
 		logger.Log(&lm)
 
-		go processor.Worker(ctx, idx, results)
+		go processor.Worker(receiveCtx, idx, results)
 	}
 
+	// Close the results channel once all workers have stopped so that the processor drains it and flushes the final batch
+	go func() {
+		wg.Wait()
+		close(results)
+
+		lm := log.Message{Level: "INFO", Msg: fmt.Sprintf("All workers have finished.")}
+		logger.Log(&lm)
+	}()
+
 	// Channel to listen for termination signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Goroutine to handle batching and inserting data from workers
-	go processor.ProcessDataFromWorker(ctx, results)
+	// Goroutine to handle batching and inserting data from workers, it returns once the final batch is flushed
+	processed := make(chan error, 1)
+	go func() {
+		processed <- processor.ProcessDataFromWorker(flushCtx, results)
+	}()
 
-	// Block until a signal is received
-	sig := <-sigChan
-	lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Received signal: %v. Shutting down gracefully...", sig)}
-	logger.Log(&lm)
-	cancel() // Cancel the context to stop worker goroutines
+	// Block until a signal is received or until all workers stopped on their own and the final batch is flushed
+	select {
+	case sig := <-sigChan:
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Received signal: %v. Shutting down gracefully...", sig)}
+		logger.Log(&lm)
 
-	// Wait for all workers to finish
-	wg.Wait()
-	lm = log.Message{Level: "INFO", Msg: fmt.Sprintf("All workers have finished.")}
+		stopReceiving() // Cancel the context to stop worker goroutines
+
+		err = waitForShutdown(processed, shutdownTimeout)
+		if err != nil {
+			// The messages of the batch still being flushed, and the ones not flushed yet, are released before the
+			// flush is cancelled rather than left invisible until their visibility timeout expires.
+			releaseCtx, cancelRelease := context.WithTimeout(context.Background(), releaseTimeout)
+			processor.Release(releaseCtx)
+			cancelRelease()
+		}
+		cancelFlush()
+	case err = <-processed:
+		stopReceiving()
+		cancelFlush()
+	}
+
+	if err != nil {
+		lm = log.Message{Level: "ERROR", ErrorMessage: fmt.Sprintf("Shut down with unflushed data: %v", err.Error())}
+		logger.Log(&lm)
+
+		_ = dbConn.Close()
+		os.Exit(1)
+	}
+
+	lm = log.Message{Level: "INFO", Msg: fmt.Sprintf("Shut down after flushing all data.")}
 	logger.Log(&lm)
 }
+
+// releaseTimeout bounds the calls releasing the messages in flight once the shutdown deadline has expired.
+const releaseTimeout = 5 * time.Second
+
+// waitForShutdown waits for the processor to drain the results and flush the final batch, for at most timeout.
+func waitForShutdown(processed <-chan error, timeout time.Duration) error {
+	select {
+	case err := <-processed:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("final batch not flushed within the shutdown timeout of %v", timeout)
+	}
+}
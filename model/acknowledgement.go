@@ -0,0 +1,85 @@
+package model
+
+import "encoding/xml"
+
+const (
+	// MaxBatchEntries is the maximum number of entries SQS accepts in a single batch action and the maximum number
+	// of messages returned by a single ReceiveMessage call.
+	MaxBatchEntries = 10
+	// MaxWaitTimeSeconds is the longest duration SQS allows a ReceiveMessage call to long poll for.
+	MaxWaitTimeSeconds = 20
+	// MaxVisibilityTimeout is the longest visibility timeout, in seconds, SQS accepts.
+	MaxVisibilityTimeout = 43200
+)
+
+type DeleteMessageBatchResponse struct {
+	XMLName                  xml.Name                 `xml:"DeleteMessageBatchResponse"`
+	DeleteMessageBatchResult DeleteMessageBatchResult `xml:"DeleteMessageBatchResult"`
+	ResponseMetadata         ResponseMetadata         `xml:"ResponseMetadata"`
+}
+
+type DeleteMessageBatchResult struct {
+	XMLName    xml.Name                        `xml:"DeleteMessageBatchResult" json:"-"`
+	Successful []DeleteMessageBatchResultEntry `xml:"DeleteMessageBatchResultEntry" json:"Successful"`
+	Failed     []BatchResultErrorEntry         `xml:"BatchResultErrorEntry" json:"Failed"`
+}
+
+type DeleteMessageBatchResultEntry struct {
+	Id string `xml:"Id" json:"Id"`
+}
+
+type ChangeMessageVisibilityBatchResponse struct {
+	XMLName                            xml.Name                           `xml:"ChangeMessageVisibilityBatchResponse"`
+	ChangeMessageVisibilityBatchResult ChangeMessageVisibilityBatchResult `xml:"ChangeMessageVisibilityBatchResult"`
+	ResponseMetadata                   ResponseMetadata                   `xml:"ResponseMetadata"`
+}
+
+type ChangeMessageVisibilityBatchResult struct {
+	XMLName    xml.Name                                  `xml:"ChangeMessageVisibilityBatchResult" json:"-"`
+	Successful []ChangeMessageVisibilityBatchResultEntry `xml:"ChangeMessageVisibilityBatchResultEntry" json:"Successful"`
+	Failed     []BatchResultErrorEntry                   `xml:"BatchResultErrorEntry" json:"Failed"`
+}
+
+type ChangeMessageVisibilityBatchResultEntry struct {
+	Id string `xml:"Id" json:"Id"`
+}
+
+// AttributeVisibilityTimeout is the queue attribute holding the default visibility timeout, in seconds, of its messages.
+const AttributeVisibilityTimeout = "VisibilityTimeout"
+
+type GetQueueAttributesResponse struct {
+	XMLName                  xml.Name                 `xml:"GetQueueAttributesResponse"`
+	GetQueueAttributesResult GetQueueAttributesResult `xml:"GetQueueAttributesResult"`
+	ResponseMetadata         ResponseMetadata         `xml:"ResponseMetadata"`
+}
+
+type GetQueueAttributesResult struct {
+	XMLName    xml.Name   `xml:"GetQueueAttributesResult" json:"-"`
+	Attributes Attributes `xml:"Attribute" json:"Attributes"`
+}
+
+type BatchResultErrorEntry struct {
+	Id          string `xml:"Id" json:"Id"`
+	Code        string `xml:"Code" json:"Code"`
+	Message     string `xml:"Message" json:"Message"`
+	SenderFault bool   `xml:"SenderFault" json:"SenderFault"`
+}
+
+type ErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Error     Error    `xml:"Error"`
+	RequestId string   `xml:"RequestId"`
+}
+
+type Error struct {
+	Type    string `xml:"Type"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// JSONErrorResponse is the error response of the SQS JSON protocol, Type is the error code prefixed with its namespace,
+// e.g. com.amazonaws.sqs#QueueDoesNotExist.
+type JSONErrorResponse struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Stages of the pipeline at which a record can fail and be dead-lettered.
+const (
+	StageParse    = "parse"
+	StageValidate = "validate"
+	StageMask     = "mask"
+	StageLoad     = "load"
+)
+
+// StageError is an error raised by a stage of the pipeline while processing a record.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%v stage failed: %v", e.Stage, e.Err.Error())
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// RowError is the error raised while loading a single record. Retryable errors are not caused by the record itself,
+// e.g. a lost connection, and the record is expected to load once redelivered.
+type RowError struct {
+	Response  *Response
+	Err       error
+	Retryable bool
+}
+
+// DeadLetter is a record that failed validation or insertion, kept with its raw body and the time its message was
+// sent so that it can be replayed.
+type DeadLetter struct {
+	Id            int64
+	MessageId     *string
+	RequestId     *string
+	RawBody       string
+	SentAt        *time.Time
+	Stage         string
+	ErrorMessage  string
+	Attempts      int
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+	ReplayedAt    *time.Time
+}
+
+// NewDeadLetter creates a DeadLetter for a message sent at sentAt, nil when unknown, that failed at the given stage.
+func NewDeadLetter(messageId *string, requestId *string, rawBody string, sentAt *time.Time, stage string, err error) *DeadLetter {
+	now := time.Now().UTC()
+
+	return &DeadLetter{
+		MessageId:     messageId,
+		RequestId:     requestId,
+		RawBody:       rawBody,
+		SentAt:        sentAt,
+		Stage:         stage,
+		ErrorMessage:  err.Error(),
+		Attempts:      1,
+		FirstFailedAt: now,
+		LastFailedAt:  now,
+	}
+}
+
+// Message rebuilds the SQS message of the dead letter so that it can be fed through the pipeline again, along with
+// its SentTimestamp attribute so that the replayed login keeps the time it happened.
+func (dl *DeadLetter) Message() *Message {
+	message := &Message{
+		MessageId: dl.MessageId,
+		Body:      dl.RawBody,
+	}
+
+	if dl.SentAt != nil {
+		message.Attributes = Attributes{AttributeSentTimestamp: strconv.FormatInt(dl.SentAt.UnixMilli(), 10)}
+	}
+
+	return message
+}
@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// DecryptionAudit is the audit record of a request through which the API returned unmasked logins. Caller is the
+// caller authenticated by its API token. LoginIds are the ids of all the logins returned, including those some fields
+// of which could not be unmasked, their other fields being returned in plaintext.
+type DecryptionAudit struct {
+	Id          int64       `json:"id"`
+	Caller      string      `json:"caller"`
+	RemoteAddr  string      `json:"remote_addr"`
+	RequestedAt time.Time   `json:"requested_at"`
+	Filter      AuditFilter `json:"filter"`
+	RowCount    int         `json:"row_count"`
+	LoginIds    []int64     `json:"login_ids"`
+}
+
+// AuditFilter is the Filter of an audited request, the searched IP and device id are only recorded through their
+// blind index so that the audit trail does not hold PII itself.
+type AuditFilter struct {
+	Limit           int    `json:"limit"`
+	Page            int    `json:"page"`
+	GroupDuplicates bool   `json:"group_duplicates"`
+	IPIndex         string `json:"ip_index,omitempty"`
+	DeviceIDIndex   string `json:"device_id_index,omitempty"`
+}
+
+// DecryptionAuditFilter selects the audit records returned by the admin API, the most recent first.
+type DecryptionAuditFilter struct {
+	Limit  int
+	Page   int
+	Caller string
+}
@@ -0,0 +1,36 @@
+package model
+
+import "time"
+
+// Modes of an erasure.
+const (
+	// ErasureModeDelete deletes the logins of the user.
+	ErasureModeDelete = "delete"
+	// ErasureModeShred deletes the data key of the user, which makes the encrypted fields of their logins unreadable,
+	// and only deletes the logins holding values not masked with that key.
+	ErasureModeShred = "shred"
+)
+
+// ErasureRequest is a right-to-be-forgotten request for all the data of a user.
+type ErasureRequest struct {
+	UserID      string `json:"user_id"`
+	RequestedBy string `json:"requested_by"`
+	Reason      string `json:"reason"`
+}
+
+// Erasure is the audit record of an erasure. The user is only recorded through the blind index of their user id, so
+// that the record does not keep the data it erased. LoginsShredded counts the logins kept with unreadable values and
+// VaultEntriesDeleted the vault entries of the tokens held by the logins of the user only.
+type Erasure struct {
+	Id                  int64     `json:"id"`
+	Mode                string    `json:"mode"`
+	UserIDIndex         string    `json:"user_id_index"`
+	RequestedBy         string    `json:"requested_by"`
+	Reason              string    `json:"reason"`
+	RequestedAt         time.Time `json:"requested_at"`
+	LoginsDeleted       int64     `json:"logins_deleted"`
+	DeadLettersDeleted  int64     `json:"dead_letters_deleted"`
+	QuarantinedDeleted  int64     `json:"quarantined_deleted"`
+	LoginsShredded      int64     `json:"logins_shredded"`
+	VaultEntriesDeleted int64     `json:"vault_entries_deleted"`
+}
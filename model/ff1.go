@@ -0,0 +1,167 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+)
+
+// ff1Rounds is the number of Feistel rounds of FF1.
+const ff1Rounds = 10
+
+// ff1MinDomain is the minimum number of possible inputs, radix^minlen, required by NIST SP 800-38G revision 1.
+const ff1MinDomain = 1000000
+
+// ff1Cipher implements the FF1 format-preserving encryption mode of NIST SP 800-38G with AES, which enciphers a
+// string of numerals in a radix into a string of numerals of the same length and radix.
+type ff1Cipher struct {
+	block cipher.Block
+}
+
+func newFF1(key []byte) (*ff1Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ff1Cipher{block: block}, nil
+}
+
+// Encrypt enciphers the numerals, each lower than radix, under the tweak.
+func (c *ff1Cipher) Encrypt(numerals []uint16, radix int, tweak []byte) ([]uint16, error) {
+	return c.cipher(numerals, radix, tweak, false)
+}
+
+// Decrypt deciphers numerals enciphered by Encrypt under the same tweak.
+func (c *ff1Cipher) Decrypt(numerals []uint16, radix int, tweak []byte) ([]uint16, error) {
+	return c.cipher(numerals, radix, tweak, true)
+}
+
+func (c *ff1Cipher) cipher(numerals []uint16, radix int, tweak []byte, decrypt bool) ([]uint16, error) {
+	n := len(numerals)
+	if radix < 2 || radix > 1<<16 {
+		return nil, errors.New("ff1: radix out of range")
+	}
+
+	if n < 2 || math.Pow(float64(radix), float64(n)) < ff1MinDomain {
+		return nil, errors.New("ff1: input too short for the radix")
+	}
+
+	for _, numeral := range numerals {
+		if int(numeral) >= radix {
+			return nil, errors.New("ff1: numeral out of range")
+		}
+	}
+
+	u := n / 2
+	v := n - u
+	a := append([]uint16(nil), numerals[:u]...)
+	b := append([]uint16(nil), numerals[u:]...)
+
+	bigRadix := big.NewInt(int64(radix))
+	byteLen := int(math.Ceil(math.Ceil(float64(v)*math.Log2(float64(radix))) / 8))
+	d := 4*((byteLen+3)/4) + 4
+
+	// P = [1]^1 || [2]^1 || [1]^1 || [radix]^3 || [10]^1 || [u mod 256]^1 || [n]^4 || [t]^4
+	p := make([]byte, aes.BlockSize)
+	p[0], p[1], p[2] = 1, 2, 1
+	p[3], p[4], p[5] = byte(radix>>16), byte(radix>>8), byte(radix)
+	p[6] = 10
+	p[7] = byte(u)
+	binary.BigEndian.PutUint32(p[8:12], uint32(n))
+	binary.BigEndian.PutUint32(p[12:16], uint32(len(tweak)))
+
+	modU := new(big.Int).Exp(bigRadix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(bigRadix, big.NewInt(int64(v)), nil)
+
+	for round := 0; round < ff1Rounds; round++ {
+		i := round
+		if decrypt {
+			i = ff1Rounds - 1 - round
+		}
+
+		// The half fed to the round function is B when enciphering and A when deciphering.
+		fed := b
+		if decrypt {
+			fed = a
+		}
+
+		y := c.round(p, tweak, i, num(fed, bigRadix), byteLen, d)
+
+		m, mod := u, modU
+		if i%2 == 1 {
+			m, mod = v, modV
+		}
+
+		if !decrypt {
+			z := new(big.Int).Add(num(a, bigRadix), y)
+			a, b = b, str(z.Mod(z, mod), bigRadix, m)
+		} else {
+			z := new(big.Int).Sub(num(b, bigRadix), y)
+			a, b = str(z.Mod(z, mod), bigRadix, m), a
+		}
+	}
+
+	return append(a, b...), nil
+}
+
+// round computes the output y of the round function for round i over the numeric value of a half.
+func (c *ff1Cipher) round(p []byte, tweak []byte, i int, half *big.Int, byteLen int, d int) *big.Int {
+	// Q = T || [0]^((-t-b-1) mod 16) || [i]^1 || [NUM(half)]^b
+	pad := (16 - (len(tweak)+byteLen+1)%16) % 16
+	q := make([]byte, 0, len(tweak)+pad+1+byteLen)
+	q = append(q, tweak...)
+	q = append(q, make([]byte, pad)...)
+	q = append(q, byte(i))
+	q = append(q, half.FillBytes(make([]byte, byteLen))...)
+
+	// R = PRF(P || Q), a CBC-MAC with a zero IV.
+	r := make([]byte, aes.BlockSize)
+	for _, input := range [][]byte{p, q} {
+		for offset := 0; offset < len(input); offset += aes.BlockSize {
+			xorBlock(r, input[offset:offset+aes.BlockSize])
+			c.block.Encrypt(r, r)
+		}
+	}
+
+	// S = R || CIPH(R xor [1]^16) || CIPH(R xor [2]^16) ... truncated to d bytes.
+	s := append([]byte(nil), r...)
+	for j := 1; len(s) < d; j++ {
+		counter := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(counter[8:], uint64(j))
+
+		block := append([]byte(nil), r...)
+		xorBlock(block, counter)
+		c.block.Encrypt(block, block)
+		s = append(s, block...)
+	}
+
+	return new(big.Int).SetBytes(s[:d])
+}
+
+// num returns the number represented by the numerals in the radix, most significant first.
+func num(numerals []uint16, radix *big.Int) *big.Int {
+	x := new(big.Int)
+	for _, numeral := range numerals {
+		x.Mul(x, radix)
+		x.Add(x, big.NewInt(int64(numeral)))
+	}
+
+	return x
+}
+
+// str returns the m numerals representing x in the radix, most significant first.
+func str(x *big.Int, radix *big.Int, m int) []uint16 {
+	numerals := make([]uint16, m)
+	x = new(big.Int).Set(x)
+	digit := new(big.Int)
+	for i := m - 1; i >= 0; i-- {
+		x.DivMod(x, radix, digit)
+		numerals[i] = uint16(digit.Int64())
+	}
+
+	return numerals
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// numerals returns the numerals of a string of digits and lowercase letters in radix 36.
+func numerals(t *testing.T, s string) []uint16 {
+	t.Helper()
+
+	var result []uint16
+	for _, r := range s {
+		numeral, err := strconv.ParseUint(string(r), 36, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result = append(result, uint16(numeral))
+	}
+
+	return result
+}
+
+// TestFF1Samples checks the cipher against the AES-128, AES-192 and AES-256 samples of NIST SP 800-38G.
+func TestFF1Samples(t *testing.T) {
+	keys := map[string]string{
+		"AES-128": "2b7e151628aed2a6abf7158809cf4f3c",
+		"AES-192": "2b7e151628aed2a6abf7158809cf4f3cef4359d8d580aa4f",
+		"AES-256": "2b7e151628aed2a6abf7158809cf4f3cef4359d8d580aa4f7f036d6f04fc6a94",
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		radix      int
+		tweak      string
+		plaintext  string
+		ciphertext string
+	}{
+		{"sample 1", "AES-128", 10, "", "0123456789", "2433477484"},
+		{"sample 2", "AES-128", 10, "39383736353433323130", "0123456789", "6124200773"},
+		{"sample 3", "AES-128", 36, "3737373770717273373737", "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+		{"sample 4", "AES-192", 10, "", "0123456789", "2830668132"},
+		{"sample 5", "AES-192", 10, "39383736353433323130", "0123456789", "2496655549"},
+		{"sample 6", "AES-192", 36, "3737373770717273373737", "0123456789abcdefghi", "xbj3kv35jrawxv32ysr"},
+		{"sample 7", "AES-256", 10, "", "0123456789", "6657667009"},
+		{"sample 8", "AES-256", 10, "39383736353433323130", "0123456789", "1001623463"},
+		{"sample 9", "AES-256", 36, "3737373770717273373737", "0123456789abcdefghi", "xs8a0azh2avyalyzuwd"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name+" "+tc.key, func(t *testing.T) {
+			ff1, err := newFF1(decodeHex(t, keys[tc.key]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tweak := decodeHex(t, tc.tweak)
+			plaintext, want := numerals(t, tc.plaintext), numerals(t, tc.ciphertext)
+
+			ciphertext, err := ff1.Encrypt(plaintext, tc.radix, tweak)
+			if err != nil || !reflect.DeepEqual(ciphertext, want) {
+				t.Fatalf("Encrypt = %v, %v, want %v", ciphertext, err, want)
+			}
+
+			deciphered, err := ff1.Decrypt(ciphertext, tc.radix, tweak)
+			if err != nil || !reflect.DeepEqual(deciphered, plaintext) {
+				t.Fatalf("Decrypt = %v, %v, want %v", deciphered, err, plaintext)
+			}
+		})
+	}
+}
+
+func TestFF1RejectsSmallDomains(t *testing.T) {
+	ff1, err := newFF1(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10^5 inputs are below the minimum domain of one million.
+	_, err = ff1.Encrypt(numerals(t, "01234"), 10, nil)
+	if err == nil {
+		t.Error("Encrypt of 5 decimal digits succeeded")
+	}
+
+	_, err = ff1.Encrypt(numerals(t, "0123456789a"), 10, nil)
+	if err == nil {
+		t.Error("Encrypt of a numeral out of the radix succeeded")
+	}
+}
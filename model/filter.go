@@ -5,4 +5,32 @@ type Filter struct {
 	Page            int
 	IsEncrypted     bool
 	GroupDuplicates bool
+	IP              string
+	DeviceID        string
+}
+
+// SearchesPII reports whether the logins are searched by IP or device id, the response telling whether a login with
+// that value exists even when the logins are returned masked.
+func (f *Filter) SearchesPII() bool {
+	return f.IP != "" || f.DeviceID != ""
+}
+
+// Audited returns the filter as recorded in the audit trail, with the searched IP and device id replaced by their
+// blind index.
+func (f *Filter) Audited(masker Masker) AuditFilter {
+	audited := AuditFilter{
+		Limit:           f.Limit,
+		Page:            f.Page,
+		GroupDuplicates: f.GroupDuplicates,
+	}
+
+	if f.IP != "" {
+		audited.IPIndex = masker.BlindIndex(FieldIP, f.IP)
+	}
+
+	if f.DeviceID != "" {
+		audited.DeviceIDIndex = masker.BlindIndex(FieldDeviceID, f.DeviceID)
+	}
+
+	return audited
 }
@@ -0,0 +1,298 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Names of the key providers holding the master keys.
+const (
+	KeyProviderEnv  = "env"
+	KeyProviderFile = "file"
+	KeyProviderKMS  = "kms"
+)
+
+// DataKey is a key masking values, those of a batch or of a user. Only its wrapped form is stored, next to the id of
+// the master key that wrapped it, its plaintext is recovered through the KeyProvider holding that master key.
+type DataKey struct {
+	ID          string
+	MasterKeyID string
+	Wrapped     []byte
+	CreatedAt   time.Time
+}
+
+// KeyProvider holds the master keys and wraps the data keys with them, master keys never leave the provider.
+type KeyProvider interface {
+	// WrapKey encrypts a data key with the active master key and returns the id of that master key with the result.
+	WrapKey(ctx context.Context, plaintext []byte) (string, []byte, error)
+	// UnwrapKey decrypts a data key wrapped by the master key with the given id.
+	UnwrapKey(ctx context.Context, masterKeyID string, wrapped []byte) ([]byte, error)
+	// ActiveKeyID returns the id of the active master key, the other master keys being retired.
+	ActiveKeyID(ctx context.Context) (string, error)
+}
+
+// ErrDataKeyNotFound is returned by a DataKeyStore when no data key has the requested id.
+var ErrDataKeyNotFound = errors.New("data key not found")
+
+// ErrDataKeyShredded is returned by a DataKeyStore when the data key with the requested id was shredded, it wraps
+// ErrDataKeyNotFound.
+var ErrDataKeyShredded = fmt.Errorf("%w, it was shredded", ErrDataKeyNotFound)
+
+// DataKeyStore persists the wrapped data keys by id.
+type DataKeyStore interface {
+	// Put stores the data key, an error is returned when a data key with the same id, or its tombstone, is stored.
+	Put(ctx context.Context, key *DataKey) error
+	Get(ctx context.Context, id string) (*DataKey, error)
+	// Retired returns, ordered by id, at most limit data keys with an id greater than afterID that are wrapped by
+	// another master key than the active one. Tombstones are not returned.
+	Retired(ctx context.Context, activeMasterKeyID string, afterID string, limit int) ([]*DataKey, error)
+	// Rewrap replaces the wrapped form of the data key by the one of key, unless the data key was meanwhile shredded
+	// or rewrapped by another master key than previousMasterKeyID.
+	Rewrap(ctx context.Context, key *DataKey, previousMasterKeyID string) error
+	// Shred replaces the data key with the given id by a tombstone, whether it is stored or not, so that values masked
+	// with it can no longer be unmasked and no data key is stored with that id again. The instances sharing the store
+	// are notified so that they drop the key from their cache.
+	Shred(ctx context.Context, id string) error
+}
+
+// KeyProviderConfig selects and configures the KeyProvider. Keyring is the keyring read from the environment, used
+// by the env provider, and KMSToken the bearer token the kms provider authenticates with.
+type KeyProviderConfig struct {
+	Provider    string
+	KeyFile     string
+	KMSEndpoint string
+	KMSToken    string
+	Keyring     *Keyring
+}
+
+// NewKeyProvider creates the KeyProvider selected by the configuration, the env provider being the default.
+func NewKeyProvider(config KeyProviderConfig) (KeyProvider, error) {
+	switch config.Provider {
+	case "", KeyProviderEnv:
+		if config.Keyring == nil {
+			return nil, errors.New("env key provider requires ENCRYPTION_SECRET or ENCRYPTION_KEYS")
+		}
+
+		return NewLocalKeyProvider(config.Keyring), nil
+	case KeyProviderFile:
+		keyring, err := LoadKeyFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewLocalKeyProvider(keyring), nil
+	case KeyProviderKMS:
+		if config.KMSEndpoint == "" || config.KMSToken == "" {
+			return nil, errors.New("kms key provider requires KMS_ENDPOINT and KMS_TOKEN")
+		}
+
+		return NewKMSKeyProvider(config.KMSEndpoint, config.KMSToken), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown key provider %q", config.Provider))
+	}
+}
+
+// keyFile is the format of a master key file, e.g. {"active_key_id": "2024-06", "keys": {"2024-06": "..."}}.
+type keyFile struct {
+	ActiveKeyID string            `json:"active_key_id"`
+	Keys        map[string]string `json:"keys"`
+}
+
+// LoadKeyFile reads a keyring of master keys from a JSON key file.
+func LoadKeyFile(path string) (*Keyring, error) {
+	if path == "" {
+		return nil, errors.New("key file path is empty")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyFile
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid key file %v: %v", path, err.Error()))
+	}
+
+	return NewKeyring(file.ActiveKeyID, file.Keys)
+}
+
+type localKeyProvider struct {
+	keyring *Keyring
+}
+
+// NewLocalKeyProvider creates a KeyProvider wrapping data keys with AES-256-GCM under keys derived from the secrets
+// of the keyring, whether they come from the environment or from a key file.
+func NewLocalKeyProvider(keyring *Keyring) KeyProvider {
+	return &localKeyProvider{keyring: keyring}
+}
+
+// WrapKey encrypts the data key under the active master key, the nonce is prepended to the result.
+func (p *localKeyProvider) WrapKey(_ context.Context, plaintext []byte) (string, []byte, error) {
+	masterKeyID := p.keyring.ActiveKeyID
+
+	aead, err := p.aead(masterKeyID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return masterKeyID, aead.Seal(nonce, nonce, plaintext, []byte(masterKeyID)), nil
+}
+
+// ActiveKeyID returns the id of the active key of the keyring.
+func (p *localKeyProvider) ActiveKeyID(_ context.Context) (string, error) {
+	return p.keyring.ActiveKeyID, nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey.
+func (p *localKeyProvider) UnwrapKey(_ context.Context, masterKeyID string, wrapped []byte) ([]byte, error) {
+	aead, err := p.aead(masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(masterKeyID))
+}
+
+func (p *localKeyProvider) aead(masterKeyID string) (cipher.AEAD, error) {
+	secret, ok := p.keyring.Key(masterKeyID)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown master key id %v", masterKeyID))
+	}
+
+	block, err := aes.NewCipher(deriveKey(secret, "data-key-wrap"))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// WrapKeyRequest and the following types are the JSON bodies of the KMS stand-in API.
+type WrapKeyRequest struct {
+	Plaintext []byte `json:"plaintext"`
+}
+
+type WrapKeyResponse struct {
+	KeyID      string `json:"key_id"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type UnwrapKeyRequest struct {
+	KeyID      string `json:"key_id"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type UnwrapKeyResponse struct {
+	Plaintext []byte `json:"plaintext"`
+}
+
+type ActiveKeyResponse struct {
+	KeyID string `json:"key_id"`
+}
+
+type kmsKeyProvider struct {
+	endpoint   string
+	token      string
+	httpClient *http.Client
+}
+
+// NewKMSKeyProvider creates a KeyProvider delegating the wrapping of data keys to the KMS stand-in listening at
+// endpoint, which holds the master keys. Requests are authenticated with token as a bearer token.
+func NewKMSKeyProvider(endpoint string, token string) KeyProvider {
+	return &kmsKeyProvider{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WrapKey asks the KMS to encrypt the data key under its active master key.
+func (p *kmsKeyProvider) WrapKey(ctx context.Context, plaintext []byte) (string, []byte, error) {
+	var res WrapKeyResponse
+
+	err := p.call(ctx, "/wrap", WrapKeyRequest{Plaintext: plaintext}, &res)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return res.KeyID, res.Ciphertext, nil
+}
+
+// UnwrapKey asks the KMS to decrypt a data key wrapped by the master key with the given id.
+func (p *kmsKeyProvider) UnwrapKey(ctx context.Context, masterKeyID string, wrapped []byte) ([]byte, error) {
+	var res UnwrapKeyResponse
+
+	err := p.call(ctx, "/unwrap", UnwrapKeyRequest{KeyID: masterKeyID, Ciphertext: wrapped}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Plaintext, nil
+}
+
+// ActiveKeyID asks the KMS for the id of its active master key.
+func (p *kmsKeyProvider) ActiveKeyID(ctx context.Context) (string, error) {
+	var res ActiveKeyResponse
+
+	err := p.call(ctx, "/active-key", struct{}{}, &res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.KeyID, nil
+}
+
+func (p *kmsKeyProvider) call(ctx context.Context, path string, body interface{}, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.token)
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("kms %v failed with status %d: %v", path, resp.StatusCode, strings.TrimSpace(string(content))))
+	}
+
+	return json.Unmarshal(content, result)
+}
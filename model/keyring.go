@@ -0,0 +1,93 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultKeyID is the id of the key given by ENCRYPTION_SECRET. Values masked before keys had ids, legacy AES-CBC
+// and untagged AES-SIV values, are unmasked with it.
+const DefaultKeyID = "default"
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+// Keyring holds the encryption keys by id. The active key masks new values while retired keys are only kept to
+// unmask the values written before the rotation, until they are remasked under the active key.
+type Keyring struct {
+	ActiveKeyID string
+	keys        map[string]string
+}
+
+// NewKeyring creates a Keyring from keys by id, activeKeyID must be one of them.
+func NewKeyring(activeKeyID string, keys map[string]string) (*Keyring, error) {
+	for id, secret := range keys {
+		if !keyIDPattern.MatchString(id) {
+			return nil, errors.New(fmt.Sprintf("invalid key id %q", id))
+		}
+
+		if secret == "" {
+			return nil, errors.New(fmt.Sprintf("key %v is empty", id))
+		}
+	}
+
+	if _, ok := keys[activeKeyID]; !ok {
+		return nil, errors.New(fmt.Sprintf("active key %q is not in the keyring", activeKeyID))
+	}
+
+	return &Keyring{
+		ActiveKeyID: activeKeyID,
+		keys:        keys,
+	}, nil
+}
+
+// ParseKeyring creates a Keyring from the configuration values. secret is the key with the DefaultKeyID, keys is a
+// comma separated list of id:secret pairs and activeKeyID defaults to DefaultKeyID when empty.
+func ParseKeyring(secret string, keys string, activeKeyID string) (*Keyring, error) {
+	ring := make(map[string]string)
+	if secret != "" {
+		ring[DefaultKeyID] = secret
+	}
+
+	for _, pair := range strings.Split(keys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		id, key, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("key %q is not of the form id:secret", pair))
+		}
+
+		if _, exists := ring[id]; exists {
+			return nil, errors.New(fmt.Sprintf("duplicate key id %q", id))
+		}
+
+		ring[id] = key
+	}
+
+	if activeKeyID == "" {
+		activeKeyID = DefaultKeyID
+	}
+
+	return NewKeyring(activeKeyID, ring)
+}
+
+// Key returns the secret of the key with the given id.
+func (k *Keyring) Key(id string) (string, bool) {
+	secret, ok := k.keys[id]
+
+	return secret, ok
+}
+
+// IDs returns the ids of all the keys of the keyring.
+func (k *Keyring) IDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
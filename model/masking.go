@@ -0,0 +1,669 @@
+package model
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the masked fields, bound to their ciphertexts so that a value cannot be swapped between fields.
+const (
+	FieldIP       = "ip"
+	FieldDeviceID = "device_id"
+)
+
+// Versions of the masked value format. Values written before versioning carry no prefix and are AES-CBC ciphertexts
+// with an all-zero IV, values of later versions are prefixed with their version and a colon. Values of version v3
+// and v4 also carry the id of the key they were masked with, as in v4:<key id>:<payload>, and values of version v5
+// the id of the data key they were masked with. Values up to v3 are deterministic, later values are randomized with
+// a nonce.
+const (
+	MaskingVersionLegacy     = "v1"
+	MaskingVersionSIV        = "v2"
+	MaskingVersionKeyed      = "v3"
+	MaskingVersionRandomized = "v4"
+	MaskingVersionEnvelope   = "v5"
+)
+
+const (
+	// sivNonceSize is the size of the random nonce of randomized AES-SIV values.
+	sivNonceSize = 16
+	// dataKeySize is the size of the data keys, AES-SIV uses half of the key for CMAC and half for CTR.
+	dataKeySize = 64
+	// maxCachedDataKeys bounds the number of unwrapped data keys kept in memory.
+	maxCachedDataKeys = 10000
+	// formatPreservingDataKeyID is the id of the data key of format-preserving masking. Format-preserving values leave
+	// no room for a key id, so a single data key masks all of them.
+	formatPreservingDataKeyID = "format-preserving"
+	// TokenPrefix starts the surrogate tokens of the vault.
+	TokenPrefix = "tok_"
+	// userDataKeyPrefix starts the ids of the data keys of users, followed by the first userDataKeyIndexLength
+	// characters of the blind index of their user id so that the id fits the encryption_data_keys table.
+	userDataKeyPrefix      = "u-"
+	userDataKeyIndexLength = 48
+	// dataKeyCacheTTL bounds how long an unwrapped data key is kept in memory, and so how long the values of a user
+	// stay readable by a running instance once their data key is deleted.
+	dataKeyCacheTTL = 5 * time.Minute
+)
+
+// ErasedValue replaces, on read, the values whose data key was deleted to erase their user.
+const ErasedValue = "[erased]"
+
+// Masker masks PII values so that they can be stored and recovers them on read. As masked values are randomized,
+// duplicates are found through the blind index of the values instead.
+type Masker interface {
+	// WithDataKey returns a Masker masking values with a new data key, wrapped by the master key of the key provider
+	// and stored. A data key is used for one batch of values.
+	WithDataKey(ctx context.Context) (Masker, error)
+	// ForUser returns a Masker masking values with the data key of the user with the given user id blind index, which
+	// is generated on first use. Shredding it with ShredUser makes all the values of the user masked with it
+	// unreadable, ForUser then returns ErrDataKeyShredded.
+	ForUser(ctx context.Context, userIDIndex string) (Masker, error)
+	// ShredUser shreds the data key of the user with the given user id blind index.
+	ShredUser(ctx context.Context, userIDIndex string) error
+	// RewrapDataKeys wraps the stored data keys wrapped by a retired master key with the active one, batchSize keys at
+	// a time, and returns how many were rewrapped. An error is returned while data keys still reference a retired
+	// master key, e.g. ones that failed to unwrap, so that the retired master keys are not removed too early.
+	RewrapDataKeys(ctx context.Context, batchSize int) (int, error)
+	// ForgetDataKeys drops the data keys with the given ids, or all of them when none is given, from the cache of
+	// unwrapped data keys, e.g. once another instance shredded them.
+	ForgetDataKeys(ids ...string)
+	// Mask masks the plaintext value of the given field with the data key of the masker.
+	Mask(ctx context.Context, field string, plaintext string) (string, error)
+	// Unmask recovers the plaintext of a masked value of the given field, whatever the version it was masked with.
+	Unmask(ctx context.Context, field string, masked string) (string, error)
+	// NeedsRemask reports whether the masked value was written with a format that is no longer the current one, or,
+	// for a Masker returned by ForUser, with another data key than the one of the user.
+	NeedsRemask(masked string) bool
+	// BlindIndex returns a keyed digest of the plaintext value of the given field, equal for equal values, which
+	// allows to group and search masked values by equality without being able to recover them.
+	BlindIndex(field string, plaintext string) string
+	// Tokenize swaps the plaintext value of the given field for a surrogate token, equal for equal values, the value
+	// being kept in the vault.
+	Tokenize(ctx context.Context, field string, plaintext string) (string, error)
+	// Detokenize recovers the plaintext value of the given field a token stands for.
+	Detokenize(ctx context.Context, field string, token string) (string, error)
+	// MaskFormatPreserving masks the plaintext value of the given field into a value of the same format, equal for
+	// equal values: IP addresses stay IP addresses of the same family and the digits of other values stay digits.
+	MaskFormatPreserving(ctx context.Context, field string, plaintext string) (string, error)
+	// UnmaskFormatPreserving recovers the plaintext of a value masked by MaskFormatPreserving.
+	UnmaskFormatPreserving(ctx context.Context, field string, masked string) (string, error)
+}
+
+type sivMasker struct {
+	provider      KeyProvider
+	dataKeys      DataKeyStore
+	vault         Vault
+	legacy        *Keyring
+	sivs          map[string]*sivCipher
+	blindIndexKey []byte
+	tokenKey      []byte
+
+	// cache holds the unwrapped data keys by id, it is shared by the maskers returned by WithDataKey.
+	cache *dataKeyCache
+	// fpe holds the format-preserving key once loaded, it is shared by the maskers returned by WithDataKey.
+	fpe *fpeKeyHolder
+
+	// dataKeyID and dataKey are the data key new values are masked with, they are only set by WithDataKey and
+	// ForUser.
+	dataKeyID string
+	dataKey   *sivCipher
+}
+
+// NewMasker creates a Masker using envelope encryption: values are masked with authenticated encryption (AES-SIV),
+// a random nonce and a data key per batch or per user, data keys being wrapped by a master key of the provider and stored in
+// dataKeys. Tokenized values are kept in the vault. Values masked directly with the keys of the legacy keyring,
+// before envelope encryption, can still be unmasked when it is given, it may be nil. Blind indexes are keyed by
+// blindIndexSecret, which must differ from the legacy encryption keys.
+func NewMasker(provider KeyProvider, dataKeys DataKeyStore, vault Vault, legacy *Keyring, blindIndexSecret string) (Masker, error) {
+	if blindIndexSecret == "" {
+		return nil, errors.New("blind index secret is empty")
+	}
+
+	sivs := make(map[string]*sivCipher)
+	if legacy != nil {
+		for _, id := range legacy.IDs() {
+			secret, _ := legacy.Key(id)
+			if secret == blindIndexSecret {
+				return nil, errors.New(fmt.Sprintf("blind index secret must differ from the encryption key %v", id))
+			}
+
+			siv, err := newSIV(deriveKey(secret, "aes-siv-cmac", "aes-siv-ctr"))
+			if err != nil {
+				return nil, err
+			}
+
+			sivs[id] = siv
+		}
+	}
+
+	return &sivMasker{
+		provider:      provider,
+		dataKeys:      dataKeys,
+		vault:         vault,
+		legacy:        legacy,
+		sivs:          sivs,
+		blindIndexKey: deriveKey(blindIndexSecret, "blind-index"),
+		tokenKey:      deriveKey(blindIndexSecret, "token"),
+		cache:         &dataKeyCache{keys: make(map[string]cachedDataKey)},
+		fpe:           &fpeKeyHolder{},
+	}, nil
+}
+
+// WithDataKey generates a random data key and returns a copy of the masker bound to it.
+func (m *sivMasker) WithDataKey(ctx context.Context) (Masker, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	key, plaintext, err := m.generateDataKey(ctx, hex.EncodeToString(id))
+	if err != nil {
+		return nil, err
+	}
+
+	siv, err := newSIV(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	m.cache.put(key.ID, siv)
+
+	return m.bind(key.ID, siv), nil
+}
+
+// ForUser returns a copy of the masker bound to the data key of the user, generating the key when it is not stored.
+// No key is generated for a user whose key was shredded, the tombstone of the key preventing it.
+func (m *sivMasker) ForUser(ctx context.Context, userIDIndex string) (Masker, error) {
+	id := UserDataKeyID(userIDIndex)
+
+	siv, err := m.unwrapDataKey(ctx, id)
+	if errors.Is(err, ErrDataKeyNotFound) && !errors.Is(err, ErrDataKeyShredded) {
+		var plaintext []byte
+		_, plaintext, err = m.generateDataKey(ctx, id)
+		if err != nil {
+			// Another instance may have generated, or shredded, it meanwhile.
+			siv, err = m.unwrapDataKey(ctx, id)
+		} else {
+			siv, err = newSIV(plaintext)
+			if err == nil {
+				m.cache.put(id, siv)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m.bind(id, siv), nil
+}
+
+// ShredUser shreds the data key of the user in the store and drops it from the cache of this instance, the other
+// instances drop it from their cache once notified by the store, or within dataKeyCacheTTL otherwise.
+func (m *sivMasker) ShredUser(ctx context.Context, userIDIndex string) error {
+	id := UserDataKeyID(userIDIndex)
+
+	err := m.dataKeys.Shred(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	m.cache.delete(id)
+
+	return nil
+}
+
+// RewrapDataKeys unwraps the data keys with their retired master key and wraps them with the active one, and then
+// checks that no data key is left under a retired master key, one may have been generated meanwhile by an instance
+// still running with the previous configuration.
+func (m *sivMasker) RewrapDataKeys(ctx context.Context, batchSize int) (int, error) {
+	activeKeyID, err := m.provider.ActiveKeyID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var rewrapped int
+	var afterID string
+	for {
+		keys, err := m.dataKeys.Retired(ctx, activeKeyID, afterID, batchSize)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		if len(keys) == 0 {
+			break
+		}
+
+		for _, key := range keys {
+			plaintext, err := m.provider.UnwrapKey(ctx, key.MasterKeyID, key.Wrapped)
+			if err != nil {
+				return rewrapped, errors.New(fmt.Sprintf("unwrapping data key %v under master key %v: %v", key.ID, key.MasterKeyID, err.Error()))
+			}
+
+			previousMasterKeyID := key.MasterKeyID
+			key.MasterKeyID, key.Wrapped, err = m.provider.WrapKey(ctx, plaintext)
+			if err != nil {
+				return rewrapped, errors.New(fmt.Sprintf("wrapping data key %v: %v", key.ID, err.Error()))
+			}
+
+			err = m.dataKeys.Rewrap(ctx, key, previousMasterKeyID)
+			if err != nil {
+				return rewrapped, err
+			}
+
+			rewrapped++
+		}
+
+		afterID = keys[len(keys)-1].ID
+	}
+
+	left, err := m.dataKeys.Retired(ctx, activeKeyID, "", 1)
+	if err != nil {
+		return rewrapped, err
+	}
+
+	if len(left) > 0 {
+		return rewrapped, errors.New(fmt.Sprintf("data key %v is still wrapped by the retired master key %v", left[0].ID, left[0].MasterKeyID))
+	}
+
+	return rewrapped, nil
+}
+
+// ForgetDataKeys drops the data keys from the cache of this instance.
+func (m *sivMasker) ForgetDataKeys(ids ...string) {
+	if len(ids) == 0 {
+		m.cache.clear()
+		return
+	}
+
+	for _, id := range ids {
+		m.cache.delete(id)
+	}
+}
+
+// bind returns a copy of the masker masking new values with the given data key.
+func (m *sivMasker) bind(dataKeyID string, dataKey *sivCipher) *sivMasker {
+	bound := *m
+	bound.dataKeyID = dataKeyID
+	bound.dataKey = dataKey
+
+	return &bound
+}
+
+// UserDataKeyID returns the id of the data key of the user with the given user id blind index, which is the key id
+// of the values masked with the Masker returned by ForUser.
+func UserDataKeyID(userIDIndex string) string {
+	return userDataKeyPrefix + userIDIndex[:min(len(userIDIndex), userDataKeyIndexLength)]
+}
+
+// generateDataKey generates a random data key with the given id, has it wrapped by the key provider and stores it.
+// The stored key is returned along with its plaintext.
+func (m *sivMasker) generateDataKey(ctx context.Context, id string) (*DataKey, []byte, error) {
+	plaintext := make([]byte, dataKeySize)
+	_, err := rand.Read(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	masterKeyID, wrapped, err := m.provider.WrapKey(ctx, plaintext)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("wrapping data key: %v", err.Error()))
+	}
+
+	key := &DataKey{
+		ID:          id,
+		MasterKeyID: masterKeyID,
+		Wrapped:     wrapped,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	err = m.dataKeys.Put(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, plaintext, nil
+}
+
+// Mask encrypts the plaintext with AES-SIV under the data key of the masker using the field name and a random nonce
+// as associated data, the nonce is prepended to the ciphertext.
+func (m *sivMasker) Mask(_ context.Context, field string, plaintext string) (string, error) {
+	if m.dataKey == nil {
+		return "", errors.New("masker has no data key, values are masked with the masker returned by WithDataKey")
+	}
+
+	nonce := make([]byte, sivNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := m.dataKey.Seal([]byte(plaintext), []byte(field), nonce)
+
+	return MaskingVersionEnvelope + ":" + m.dataKeyID + ":" + base64.StdEncoding.EncodeToString(append(nonce, ciphertext...)), nil
+}
+
+// Unmask decrypts a masked value of any supported version.
+func (m *sivMasker) Unmask(ctx context.Context, field string, masked string) (string, error) {
+	version, keyID, payload, err := parseMasked(masked)
+	if err != nil {
+		return "", err
+	}
+
+	if version == MaskingVersionLegacy {
+		secret, ok := m.legacyKey(keyID)
+		if !ok {
+			return "", errors.New(fmt.Sprintf("unknown key id %v", keyID))
+		}
+
+		plaintext, err := Decrypt(payload, secret)
+		if err != nil {
+			return "", err
+		}
+
+		return *plaintext, nil
+	}
+
+	var siv *sivCipher
+	if version == MaskingVersionEnvelope {
+		siv, err = m.unwrapDataKey(ctx, keyID)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		var ok bool
+		siv, ok = m.sivs[keyID]
+		if !ok {
+			return "", errors.New(fmt.Sprintf("unknown key id %v", keyID))
+		}
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", err
+	}
+
+	associatedData := [][]byte{[]byte(field)}
+	if version == MaskingVersionRandomized || version == MaskingVersionEnvelope {
+		if len(ciphertext) < sivNonceSize {
+			return "", errSIVAuthentication
+		}
+
+		associatedData = append(associatedData, ciphertext[:sivNonceSize])
+		ciphertext = ciphertext[sivNonceSize:]
+	}
+
+	plaintext, err := siv.Open(ciphertext, associatedData...)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// NeedsRemask reports whether the value is not masked with envelope encryption yet, or not with the data key of the
+// user the masker is bound to.
+func (m *sivMasker) NeedsRemask(masked string) bool {
+	version, keyID, _, err := parseMasked(masked)
+	if err != nil || version != MaskingVersionEnvelope {
+		return true
+	}
+
+	return strings.HasPrefix(m.dataKeyID, userDataKeyPrefix) && keyID != m.dataKeyID
+}
+
+// legacyKey returns the secret of a key of the legacy keyring.
+func (m *sivMasker) legacyKey(id string) (string, bool) {
+	if m.legacy == nil {
+		return "", false
+	}
+
+	return m.legacy.Key(id)
+}
+
+// unwrapDataKey returns the cipher of the data key with the given id, fetching the key from the store and having it
+// unwrapped by the key provider when it is not cached.
+func (m *sivMasker) unwrapDataKey(ctx context.Context, id string) (*sivCipher, error) {
+	siv, ok := m.cache.get(id)
+	if ok {
+		return siv, nil
+	}
+
+	key, err := m.dataKeys.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := m.provider.UnwrapKey(ctx, key.MasterKeyID, key.Wrapped)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unwrapping data key %v: %v", id, err.Error()))
+	}
+
+	siv, err = newSIV(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	m.cache.put(id, siv)
+
+	return siv, nil
+}
+
+// MaskFormatPreserving enciphers IP addresses with formatPreservingIP and the values of other fields with
+// formatPreservingDigits, using the field name as tweak.
+func (m *sivMasker) MaskFormatPreserving(ctx context.Context, field string, plaintext string) (string, error) {
+	key, err := m.formatPreservingKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if field == FieldIP {
+		return formatPreservingIP(key, field, plaintext, false)
+	}
+
+	return formatPreservingDigits(key, field, plaintext, false)
+}
+
+// UnmaskFormatPreserving deciphers a value enciphered by MaskFormatPreserving.
+func (m *sivMasker) UnmaskFormatPreserving(ctx context.Context, field string, masked string) (string, error) {
+	key, err := m.formatPreservingKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if field == FieldIP {
+		return formatPreservingIP(key, field, masked, true)
+	}
+
+	return formatPreservingDigits(key, field, masked, true)
+}
+
+// formatPreservingKey returns the data key of format-preserving masking, which is generated on first use.
+func (m *sivMasker) formatPreservingKey(ctx context.Context) (*fpeKey, error) {
+	m.fpe.mu.Lock()
+	defer m.fpe.mu.Unlock()
+
+	if m.fpe.key != nil {
+		return m.fpe.key, nil
+	}
+
+	var plaintext []byte
+	key, err := m.dataKeys.Get(ctx, formatPreservingDataKeyID)
+	if errors.Is(err, ErrDataKeyNotFound) {
+		key, plaintext, err = m.generateDataKey(ctx, formatPreservingDataKeyID)
+		if err != nil {
+			// Another instance may have generated it meanwhile.
+			key, err = m.dataKeys.Get(ctx, formatPreservingDataKeyID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if plaintext == nil {
+		plaintext, err = m.provider.UnwrapKey(ctx, key.MasterKeyID, key.Wrapped)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("unwrapping data key %v: %v", key.ID, err.Error()))
+		}
+	}
+
+	m.fpe.key, err = newFPEKey(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.fpe.key, nil
+}
+
+// fpeKeyHolder holds the format-preserving key once it is loaded.
+type fpeKeyHolder struct {
+	mu  sync.Mutex
+	key *fpeKey
+}
+
+// dataKeyCache holds unwrapped data keys so that the key provider is only called once per data key and per
+// dataKeyCacheTTL. It is emptied once it holds maxCachedDataKeys keys.
+type dataKeyCache struct {
+	mu   sync.Mutex
+	keys map[string]cachedDataKey
+}
+
+type cachedDataKey struct {
+	siv       *sivCipher
+	expiresAt time.Time
+}
+
+func (c *dataKeyCache) get(id string) (*sivCipher, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.keys[id]
+	if !ok || time.Now().After(key.expiresAt) {
+		return nil, false
+	}
+
+	return key.siv, true
+}
+
+func (c *dataKeyCache) put(id string, siv *sivCipher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.keys) >= maxCachedDataKeys {
+		c.keys = make(map[string]cachedDataKey)
+	}
+
+	c.keys[id] = cachedDataKey{siv: siv, expiresAt: time.Now().Add(dataKeyCacheTTL)}
+}
+
+func (c *dataKeyCache) delete(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.keys, id)
+}
+
+func (c *dataKeyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keys = make(map[string]cachedDataKey)
+}
+
+// BlindIndex returns the hex encoded HMAC-SHA256 of the field name and the plaintext keyed by the blind index key.
+func (m *sivMasker) BlindIndex(field string, plaintext string) string {
+	mac := hmac.New(sha256.New, m.blindIndexKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(plaintext))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Tokenize stores the value masked with the data key of the masker in the vault under a random token. The value is
+// found in the vault by the HMAC-SHA256 of the field name and the value keyed by the token key, so that the token of
+// a value already in the vault is returned instead.
+func (m *sivMasker) Tokenize(ctx context.Context, field string, plaintext string) (string, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	masked, err := m.Mask(ctx, field, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, m.tokenKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(plaintext))
+
+	return m.vault.Store(ctx, &VaultEntry{
+		Token:       TokenPrefix + hex.EncodeToString(random),
+		Field:       field,
+		ValueIndex:  hex.EncodeToString(mac.Sum(nil)),
+		MaskedValue: masked,
+		CreatedAt:   time.Now().UTC(),
+	})
+}
+
+// Detokenize looks the token up in the vault and unmasks its value.
+func (m *sivMasker) Detokenize(ctx context.Context, field string, token string) (string, error) {
+	entry, err := m.vault.Get(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	if entry.Field != field {
+		return "", errors.New(fmt.Sprintf("token %v stands for a value of %v, not %v", token, entry.Field, field))
+	}
+
+	return m.Unmask(ctx, field, entry.MaskedValue)
+}
+
+// parseMasked splits a masked value into its version, the id of the key it was masked with and its payload. Base64
+// never contains a colon, so values without a version prefix are legacy ciphertexts. Values masked before keys had
+// ids are masked with the DefaultKeyID.
+func parseMasked(masked string) (string, string, string, error) {
+	version, rest, found := strings.Cut(masked, ":")
+	if !found {
+		return MaskingVersionLegacy, DefaultKeyID, masked, nil
+	}
+
+	switch version {
+	case MaskingVersionSIV:
+		return version, DefaultKeyID, rest, nil
+	case MaskingVersionKeyed, MaskingVersionRandomized, MaskingVersionEnvelope:
+		keyID, payload, found := strings.Cut(rest, ":")
+		if !found {
+			return "", "", "", errors.New("masked value has no key id")
+		}
+
+		return version, keyID, payload, nil
+	default:
+		return "", "", "", errors.New(fmt.Sprintf("unsupported masking version %v", version))
+	}
+}
+
+// deriveKey derives a key from the secret by concatenating an HMAC-SHA256 of each label keyed by the secret.
+func deriveKey(secret string, labels ...string) []byte {
+	key := make([]byte, 0, len(labels)*sha256.Size)
+	for _, label := range labels {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(label))
+		key = mac.Sum(key)
+	}
+
+	return key
+}
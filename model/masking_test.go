@@ -0,0 +1,340 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Keys of the legacy keyring of the test masker, the default one being the ENCRYPTION_SECRET of AES-CBC values.
+const (
+	testLegacySecret = "example key 1234"
+	testKeyID        = "2024-06"
+	testBlindSecret  = "example blind index key"
+)
+
+// memDataKeys is a DataKeyStore holding the data keys in memory.
+type memDataKeys struct {
+	keys     map[string]DataKey
+	shredded map[string]bool
+}
+
+func newMemDataKeys() *memDataKeys {
+	return &memDataKeys{keys: make(map[string]DataKey), shredded: make(map[string]bool)}
+}
+
+func (s *memDataKeys) Put(_ context.Context, key *DataKey) error {
+	if _, ok := s.keys[key.ID]; ok || s.shredded[key.ID] {
+		return errors.New("data key already stored")
+	}
+
+	s.keys[key.ID] = *key
+
+	return nil
+}
+
+func (s *memDataKeys) Get(_ context.Context, id string) (*DataKey, error) {
+	if s.shredded[id] {
+		return nil, ErrDataKeyShredded
+	}
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrDataKeyNotFound
+	}
+
+	return &key, nil
+}
+
+func (s *memDataKeys) Retired(_ context.Context, activeMasterKeyID string, afterID string, limit int) ([]*DataKey, error) {
+	var keys []*DataKey
+	for _, key := range s.keys {
+		if key.MasterKeyID != activeMasterKeyID && key.ID > afterID {
+			key := key
+			keys = append(keys, &key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	return keys, nil
+}
+
+func (s *memDataKeys) Rewrap(_ context.Context, key *DataKey, previousMasterKeyID string) error {
+	if stored, ok := s.keys[key.ID]; ok && stored.MasterKeyID == previousMasterKeyID {
+		s.keys[key.ID] = *key
+	}
+
+	return nil
+}
+
+func (s *memDataKeys) Shred(_ context.Context, id string) error {
+	delete(s.keys, id)
+	s.shredded[id] = true
+
+	return nil
+}
+
+// newTestKeyProvider returns a KeyProvider holding the given master keys by id, activeKeyID being the active one.
+func newTestKeyProvider(t *testing.T, activeKeyID string, keys map[string]string) KeyProvider {
+	t.Helper()
+
+	keyring, err := NewKeyring(activeKeyID, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewLocalKeyProvider(keyring)
+}
+
+func newTestMasker(t *testing.T) *sivMasker {
+	t.Helper()
+
+	legacy, err := NewKeyring(testKeyID, map[string]string{DefaultKeyID: testLegacySecret, testKeyID: "example rotated key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := newTestKeyProvider(t, "master-1", map[string]string{"master-1": "example master key"})
+
+	masker, err := NewMasker(provider, newMemDataKeys(), nil, legacy, testBlindSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return masker.(*sivMasker)
+}
+
+// legacyEncrypt encrypts the plaintext as values were masked before versioning, with AES-CBC, an all-zero IV and
+// PKCS#7 padding.
+func legacyEncrypt(t *testing.T, plaintext string, key string) string {
+	t.Helper()
+
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append([]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(padded, padded)
+
+	return base64.StdEncoding.EncodeToString(padded)
+}
+
+// tamper flips a bit of the byte at index i of the base64 payload of a masked value, which follows its last colon.
+// Negative indexes count from the end of the payload.
+func tamper(t *testing.T, masked string, i int) string {
+	t.Helper()
+
+	prefix, payload := "", masked
+	if idx := strings.LastIndex(masked, ":"); idx >= 0 {
+		prefix, payload = masked[:idx+1], masked[idx+1:]
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded[(i%len(decoded)+len(decoded))%len(decoded)] ^= 0x01
+
+	return prefix + base64.StdEncoding.EncodeToString(decoded)
+}
+
+// maskedVersions masks a value of a field in each of the masked value formats the masker reads.
+var maskedVersions = []struct {
+	version string
+	mask    func(t *testing.T, m *sivMasker, field string, plaintext string) string
+	// authenticated formats reject any change to the payload and values unmasked under another field.
+	authenticated bool
+}{
+	{
+		version: MaskingVersionLegacy,
+		mask: func(t *testing.T, m *sivMasker, field string, plaintext string) string {
+			return legacyEncrypt(t, plaintext, testLegacySecret)
+		},
+	},
+	{
+		version: MaskingVersionSIV,
+		mask: func(t *testing.T, m *sivMasker, field string, plaintext string) string {
+			return MaskingVersionSIV + ":" + base64.StdEncoding.EncodeToString(m.sivs[DefaultKeyID].Seal([]byte(plaintext), []byte(field)))
+		},
+		authenticated: true,
+	},
+	{
+		version: MaskingVersionKeyed,
+		mask: func(t *testing.T, m *sivMasker, field string, plaintext string) string {
+			return MaskingVersionKeyed + ":" + testKeyID + ":" + base64.StdEncoding.EncodeToString(m.sivs[testKeyID].Seal([]byte(plaintext), []byte(field)))
+		},
+		authenticated: true,
+	},
+	{
+		version: MaskingVersionRandomized,
+		mask: func(t *testing.T, m *sivMasker, field string, plaintext string) string {
+			nonce := make([]byte, sivNonceSize)
+			_, err := rand.Read(nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ciphertext := m.sivs[testKeyID].Seal([]byte(plaintext), []byte(field), nonce)
+
+			return MaskingVersionRandomized + ":" + testKeyID + ":" + base64.StdEncoding.EncodeToString(append(nonce, ciphertext...))
+		},
+		authenticated: true,
+	},
+	{
+		version: MaskingVersionEnvelope,
+		mask: func(t *testing.T, m *sivMasker, field string, plaintext string) string {
+			masker, err := m.WithDataKey(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			masked, err := masker.Mask(context.Background(), field, plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return masked
+		},
+		authenticated: true,
+	},
+}
+
+func TestUnmaskVersions(t *testing.T) {
+	ctx := context.Background()
+	masker := newTestMasker(t)
+
+	for _, tc := range maskedVersions {
+		t.Run(tc.version, func(t *testing.T) {
+			masked := tc.mask(t, masker, FieldIP, "199.172.111.135")
+
+			plaintext, err := masker.Unmask(ctx, FieldIP, masked)
+			if err != nil || plaintext != "199.172.111.135" {
+				t.Fatalf("Unmask(%q) = %q, %v", masked, plaintext, err)
+			}
+
+			if !tc.authenticated {
+				// Legacy values are not authenticated, only malformed values and broken padding are rejected.
+				_, err = masker.Unmask(ctx, FieldIP, masked[:len(masked)-4])
+				if err == nil {
+					t.Error("Unmask of a truncated legacy value succeeded")
+				}
+
+				_, err = masker.Unmask(ctx, FieldIP, tamper(t, masked, -1))
+				if err == nil {
+					t.Error("Unmask of a legacy value with a broken padding succeeded")
+				}
+
+				return
+			}
+
+			for i := 0; i < 40; i++ {
+				_, err = masker.Unmask(ctx, FieldIP, tamper(t, masked, i))
+				if err == nil {
+					t.Fatalf("Unmask of a value tampered at byte %d succeeded", i)
+				}
+			}
+
+			_, err = masker.Unmask(ctx, FieldDeviceID, masked)
+			if err == nil {
+				t.Error("Unmask of a value of another field succeeded")
+			}
+
+			// A key id swapped for another key of the keyring is detected as well.
+			if strings.Contains(masked, ":"+testKeyID+":") {
+				_, err = masker.Unmask(ctx, FieldIP, strings.Replace(masked, ":"+testKeyID+":", ":"+DefaultKeyID+":", 1))
+				if err == nil {
+					t.Error("Unmask of a value under another key id succeeded")
+				}
+			}
+		})
+	}
+}
+
+func TestUnmaskShreddedUser(t *testing.T) {
+	ctx := context.Background()
+	masker := newTestMasker(t)
+
+	userMasker, err := masker.ForUser(ctx, "user-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masked, err := userMasker.Mask(ctx, FieldIP, "199.172.111.135")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = masker.ShredUser(ctx, "user-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = masker.Unmask(ctx, FieldIP, masked)
+	if !errors.Is(err, ErrDataKeyShredded) {
+		t.Errorf("Unmask of a value of a shredded user = %v, want ErrDataKeyShredded", err)
+	}
+
+	// No key is generated again for the user.
+	_, err = masker.ForUser(ctx, "user-index")
+	if !errors.Is(err, ErrDataKeyShredded) {
+		t.Errorf("ForUser of a shredded user = %v, want ErrDataKeyShredded", err)
+	}
+}
+
+func TestRewrapDataKeys(t *testing.T) {
+	ctx := context.Background()
+	masker := newTestMasker(t)
+	dataKeys := masker.dataKeys.(*memDataKeys)
+
+	batchMasker, err := masker.WithDataKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masked, err := batchMasker.Mask(ctx, FieldDeviceID, "593-47-5928")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = dataKeys.Shred(ctx, "shredded-key")
+
+	// The master key is rotated, the retired one being kept to unwrap the existing data keys.
+	masker.provider = newTestKeyProvider(t, "master-2", map[string]string{"master-1": "example master key", "master-2": "example new master key"})
+
+	rewrapped, err := masker.RewrapDataKeys(ctx, 1)
+	if err != nil || rewrapped != 1 {
+		t.Fatalf("RewrapDataKeys = %d, %v, want 1 data key rewrapped", rewrapped, err)
+	}
+
+	// The value is unmasked once the retired master key is removed.
+	masker.provider = newTestKeyProvider(t, "master-2", map[string]string{"master-2": "example new master key"})
+	masker.ForgetDataKeys()
+
+	plaintext, err := masker.Unmask(ctx, FieldDeviceID, masked)
+	if err != nil || plaintext != "593-47-5928" {
+		t.Errorf("Unmask after the rotation = %q, %v", plaintext, err)
+	}
+
+	// A data key that cannot be unwrapped keeps the rotation from being reported as done.
+	_ = dataKeys.Put(ctx, &DataKey{ID: "unknown-master", MasterKeyID: "master-0", Wrapped: []byte("wrapped")})
+
+	_, err = masker.RewrapDataKeys(ctx, 10)
+	if err == nil {
+		t.Error("RewrapDataKeys succeeded with a data key under an unknown master key")
+	}
+}
@@ -1,7 +1,11 @@
 package model
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -11,31 +15,152 @@ type ReceiveMessageResponse struct {
 	ResponseMetadata     ResponseMetadata     `xml:"ResponseMetadata"`
 }
 
+// ReceiveMessageResult is the result of a ReceiveMessage call, the whole response of the SQS JSON protocol and the
+// result element of the XML query protocol.
 type ReceiveMessageResult struct {
-	XMLName xml.Name `xml:"ReceiveMessageResult"`
-	Message *Message `xml:"Message"`
+	XMLName  xml.Name   `xml:"ReceiveMessageResult" json:"-"`
+	Messages []*Message `xml:"Message" json:"Messages"`
 }
 
 type Response struct {
+	LoginId       int64     `json:"-"`
 	RequestId     *string   `json:"-"`
 	MessageId     *string   `json:"-"`
 	ReceiptHandle string    `json:"-"`
 	MD5OfBody     string    `json:"-"`
+	RawBody       string    `json:"-"`
 	UserID        *string   `json:"user_id"`
+	UserIDIndex   *string   `json:"-"`
 	AppVersion    string    `json:"app_version"`
 	DeviceType    *string   `json:"device_type"`
 	IP            *string   `json:"ip"`
+	IPIndex       *string   `json:"-"`
 	Locale        string    `json:"locale"`
 	DeviceID      *string   `json:"device_id"`
+	DeviceIDIndex *string   `json:"-"`
 	CreatedDate   time.Time `json:"-"`
+	// SentAt, FirstReceivedAt and ReceiveCount are the SentTimestamp, ApproximateFirstReceiveTimestamp and
+	// ApproximateReceiveCount attributes of the message, nil when SQS did not return them.
+	SentAt          *time.Time `json:"-"`
+	FirstReceivedAt *time.Time `json:"-"`
+	ReceiveCount    *int       `json:"-"`
+	// MessageGroupId and SequenceNumber order the messages of a FIFO queue, messages of a group being delivered in
+	// the order of their sequence number. ReceiveRequestAttemptId identifies the ReceiveMessage call that received the
+	// message from a FIFO queue. They are nil, or empty, for the messages of a standard queue.
+	MessageGroupId          *string `json:"-"`
+	SequenceNumber          *string `json:"-"`
+	ReceiveRequestAttemptId string  `json:"-"`
+	// UnmaskFailed flags, on read, a Response some fields of which could not be unmasked and are returned masked.
+	UnmaskFailed bool `json:"unmask_failed,omitempty"`
 }
 
 type Message struct {
-	XMLName       xml.Name `xml:"Message"`
-	MessageId     *string  `xml:"MessageId"`
-	ReceiptHandle string   `xml:"ReceiptHandle"`
-	MD5OfBody     string   `xml:"MD5OfBody"`
-	Body          string   `xml:"Body"`
+	XMLName           xml.Name          `xml:"Message" json:"-"`
+	MessageId         *string           `xml:"MessageId" json:"MessageId"`
+	ReceiptHandle     string            `xml:"ReceiptHandle" json:"ReceiptHandle"`
+	MD5OfBody         string            `xml:"MD5OfBody" json:"MD5OfBody"`
+	Body              string            `xml:"Body" json:"Body"`
+	Attributes        Attributes        `xml:"Attribute" json:"Attributes"`
+	MessageAttributes MessageAttributes `xml:"MessageAttribute" json:"MessageAttributes"`
+}
+
+// Names of the system attributes of a message.
+const (
+	AttributeSentTimestamp                    = "SentTimestamp"
+	AttributeApproximateReceiveCount          = "ApproximateReceiveCount"
+	AttributeApproximateFirstReceiveTimestamp = "ApproximateFirstReceiveTimestamp"
+	AttributeMessageGroupId                   = "MessageGroupId"
+	AttributeSequenceNumber                   = "SequenceNumber"
+)
+
+// Attributes are the system attributes of a message by name, the Attribute elements of the query protocol or the
+// Attributes object of the JSON protocol.
+type Attributes map[string]string
+
+// UnmarshalXML adds a single Attribute element to the attributes.
+func (a *Attributes) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var attribute struct {
+		Name  string `xml:"Name"`
+		Value string `xml:"Value"`
+	}
+
+	err := d.DecodeElement(&attribute, &start)
+	if err != nil {
+		return err
+	}
+
+	if *a == nil {
+		*a = make(Attributes)
+	}
+
+	(*a)[attribute.Name] = attribute.Value
+
+	return nil
+}
+
+// Timestamp returns the attribute holding a timestamp in milliseconds since the epoch, nil when it is missing or
+// invalid.
+func (a Attributes) Timestamp(name string) *time.Time {
+	millis, err := strconv.ParseInt(a[name], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	timestamp := time.UnixMilli(millis).UTC()
+
+	return &timestamp
+}
+
+// String returns the attribute, nil when it is missing.
+func (a Attributes) String(name string) *string {
+	value, ok := a[name]
+	if !ok {
+		return nil
+	}
+
+	return &value
+}
+
+// Int returns the attribute holding an integer, nil when it is missing or invalid.
+func (a Attributes) Int(name string) *int {
+	value, err := strconv.Atoi(a[name])
+	if err != nil {
+		return nil
+	}
+
+	return &value
+}
+
+// MessageAttributeValue is the value of a custom attribute of a message, BinaryValue being base64 encoded.
+type MessageAttributeValue struct {
+	DataType    string `xml:"DataType" json:"DataType"`
+	StringValue string `xml:"StringValue" json:"StringValue,omitempty"`
+	BinaryValue string `xml:"BinaryValue" json:"BinaryValue,omitempty"`
+}
+
+// MessageAttributes are the custom attributes of a message by name, the MessageAttribute elements of the query
+// protocol or the MessageAttributes object of the JSON protocol.
+type MessageAttributes map[string]MessageAttributeValue
+
+// UnmarshalXML adds a single MessageAttribute element to the attributes.
+func (a *MessageAttributes) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var attribute struct {
+		Name  string                `xml:"Name"`
+		Value MessageAttributeValue `xml:"Value"`
+	}
+
+	err := d.DecodeElement(&attribute, &start)
+	if err != nil {
+		return err
+	}
+
+	if *a == nil {
+		*a = make(MessageAttributes)
+	}
+
+	(*a)[attribute.Name] = attribute.Value
+
+	return nil
 }
 
 type ResponseMetadata struct {
@@ -51,33 +176,111 @@ func (res *Response) Validate() bool {
 	return true
 }
 
-// SetData sets the data fields of the Response struct based on the SQS message response.
-func (res *Response) SetData(sqsMessageResponse ReceiveMessageResponse) {
-	res.RequestId = sqsMessageResponse.ResponseMetadata.RequestId
-	res.MessageId = sqsMessageResponse.ReceiveMessageResult.Message.MessageId
-	res.ReceiptHandle = sqsMessageResponse.ReceiveMessageResult.Message.ReceiptHandle
-	res.MD5OfBody = sqsMessageResponse.ReceiveMessageResult.Message.MD5OfBody
+// Precedes reports whether the response comes before other in their FIFO message group, comparing their sequence
+// numbers, which are large decimal integers.
+func (res *Response) Precedes(other *Response) bool {
+	a, b := valueOf(res.SequenceNumber), valueOf(other.SequenceNumber)
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
 }
 
-// MaskBody encrypts the DeviceID and IP fields of the Response struct if they are not empty.
-func (res *Response) MaskBody(key string) error {
-	if res.DeviceID != nil {
-		encryptedDeviceId, err := encrypt(*res.DeviceID, key)
+// SetData sets the data fields of the Response struct based on a message of the SQS message response. The login
+// happened when the message was sent, CreatedDate is left unset when the SentTimestamp attribute is missing.
+func (res *Response) SetData(requestId *string, message *Message) {
+	res.RequestId = requestId
+	res.MessageId = message.MessageId
+	res.ReceiptHandle = message.ReceiptHandle
+	res.MD5OfBody = message.MD5OfBody
+	res.RawBody = message.Body
+	res.SentAt = message.Attributes.Timestamp(AttributeSentTimestamp)
+	res.FirstReceivedAt = message.Attributes.Timestamp(AttributeApproximateFirstReceiveTimestamp)
+	res.ReceiveCount = message.Attributes.Int(AttributeApproximateReceiveCount)
+	res.MessageGroupId = message.Attributes.String(AttributeMessageGroupId)
+	res.SequenceNumber = message.Attributes.String(AttributeSequenceNumber)
+
+	if res.SentAt != nil {
+		res.CreatedDate = *res.SentAt
+	}
+}
+
+// MaskBody masks the payload fields of the Response struct that are not empty according to the masking policy. The
+// blind index of the UserID is computed beforehand unless it is redacted, those of the DeviceID and IP fields only
+// when the policy searches them through one. The masker
+// must be bound to the data key of the batch, encrypted fields are masked with the data key of the user instead when
+// the policy scopes keys to users.
+func (res *Response) MaskBody(ctx context.Context, masker Masker, policy *MaskingPolicy) error {
+	if res.UserID != nil && policy.Action(FieldUserID) != ActionRedact {
+		userIdIndex := masker.BlindIndex(FieldUserID, *res.UserID)
+		res.UserIDIndex = &userIdIndex
+	}
+
+	encrypter := masker
+	if policy.UserKeys() && res.UserID != nil {
+		var err error
+		encrypter, err = masker.ForUser(ctx, masker.BlindIndex(FieldUserID, *res.UserID))
 		if err != nil {
-			return err
+			return fmt.Errorf("loading user data key: %w", err)
 		}
+	}
 
-		res.DeviceID = encryptedDeviceId
+	if res.DeviceID != nil {
+		res.DeviceIDIndex = policy.blindIndex(masker, FieldDeviceID, *res.DeviceID)
 	}
 
 	if res.IP != nil {
-		encryptedIP, err := encrypt(*res.IP, key)
+		res.IPIndex = policy.blindIndex(masker, FieldIP, *res.IP)
+	}
+
+	for _, name := range responseFieldNames() {
+		field := responseFields[name]
+
+		value := field.get(res)
+		if value == nil {
+			continue
+		}
+
+		fieldMasker := masker
+		if policy.Action(name) == ActionEncrypt {
+			fieldMasker = encrypter
+		}
+
+		masked, err := policy.mask(ctx, fieldMasker, name, *value)
 		if err != nil {
-			return err
+			return fmt.Errorf("masking %v: %w", name, err)
 		}
 
-		res.IP = encryptedIP
+		field.set(res, masked)
 	}
 
 	return nil
 }
+
+// UnmaskBody recovers the plaintext of the payload fields of the Response struct that are not empty and were masked
+// reversibly, whatever the current action of their field for the values whose format tells how they were masked.
+// Values of erased users whose data key was shredded read as the ErasedValue. Fields that cannot be unmasked keep
+// their masked value, the errors of all of them are returned.
+func (res *Response) UnmaskBody(ctx context.Context, masker Masker, policy *MaskingPolicy) error {
+	var errs []error
+
+	for _, name := range responseFieldNames() {
+		field := responseFields[name]
+
+		value := field.get(res)
+		if value == nil {
+			continue
+		}
+
+		plaintext, err := policy.unmask(ctx, masker, name, *value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unmasking %v: %w", name, err))
+			continue
+		}
+
+		field.set(res, &plaintext)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,371 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Names of the other payload fields of the Response, along with FieldIP and FieldDeviceID.
+const (
+	FieldUserID     = "user_id"
+	FieldAppVersion = "app_version"
+	FieldDeviceType = "device_type"
+	FieldLocale     = "locale"
+)
+
+// Masking actions of a field. Encrypted values, including format-preserving ones, and tokenized values are the only
+// ones recovered on read, the others are irreversible.
+const (
+	// ActionEncrypt masks the value with the envelope encryption of the Masker.
+	ActionEncrypt = "encrypt"
+	// ActionHash replaces the value with its keyed HMAC-SHA256, equal for equal values.
+	ActionHash = "hash"
+	// ActionTokenize replaces the value with a random surrogate token, the value being kept in the vault.
+	ActionTokenize = "tokenize"
+	// ActionFormatPreserving encrypts the value into a value of the same format, an IP address into an IP address of
+	// the same family or the digits of a device id into digits.
+	ActionFormatPreserving = "fpe"
+	// ActionTruncate keeps the network prefix of an IP address, e.g. the /24 of an IPv4, or the first characters of
+	// any other value.
+	ActionTruncate = "truncate"
+	// ActionRedact removes the value.
+	ActionRedact = "redact"
+	// ActionPass stores the value as is, fields missing from a policy are passed through.
+	ActionPass = "pass"
+)
+
+// Scopes of the data keys encrypted values are masked with.
+const (
+	// KeyScopeBatch masks the values of a batch with a data key of their own.
+	KeyScopeBatch = "batch"
+	// KeyScopeUser masks the values of a user with a data key of their own, so that the user is erased by deleting
+	// their key rather than their rows.
+	KeyScopeUser = "user"
+)
+
+// Default prefix lengths IP addresses are truncated to.
+const (
+	defaultIPv4PrefixLength = 24
+	defaultIPv6PrefixLength = 48
+)
+
+// FieldPolicy is the masking action of a field along with its parameters.
+type FieldPolicy struct {
+	Action string `json:"action"`
+	// IPv4PrefixLength and IPv6PrefixLength are the prefix lengths IP addresses are truncated to.
+	IPv4PrefixLength int `json:"ipv4_prefix_length,omitempty"`
+	IPv6PrefixLength int `json:"ipv6_prefix_length,omitempty"`
+	// Length is the number of characters kept when truncating values other than IP addresses.
+	Length int `json:"length,omitempty"`
+}
+
+// MaskingPolicy maps the payload fields of the Response, by their JSON name, to their masking action, e.g.
+// {"fields": {"ip": {"action": "truncate", "ipv4_prefix_length": 24}, "device_id": {"action": "encrypt"}}}. KeyScope
+// is the scope of the data keys of encrypted fields, KeyScopeBatch by default.
+type MaskingPolicy struct {
+	KeyScope string                 `json:"key_scope,omitempty"`
+	Fields   map[string]FieldPolicy `json:"fields"`
+}
+
+// DefaultMaskingPolicy returns the policy used when no policy file is configured, which encrypts the IP and the
+// device id and passes the other fields through.
+func DefaultMaskingPolicy() *MaskingPolicy {
+	return &MaskingPolicy{
+		Fields: map[string]FieldPolicy{
+			FieldIP:       {Action: ActionEncrypt},
+			FieldDeviceID: {Action: ActionEncrypt},
+		},
+	}
+}
+
+// LoadMaskingPolicy reads a masking policy from a JSON file, the DefaultMaskingPolicy is returned when path is empty.
+func LoadMaskingPolicy(path string) (*MaskingPolicy, error) {
+	if path == "" {
+		return DefaultMaskingPolicy(), nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy MaskingPolicy
+	err = json.Unmarshal(content, &policy)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid masking policy %v: %v", path, err.Error()))
+	}
+
+	err = policy.Validate()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid masking policy %v: %v", path, err.Error()))
+	}
+
+	return &policy, nil
+}
+
+// Validate checks that the policy only names known fields and actions with valid parameters, fpe fields being rejected
+// along with KeyScopeUser.
+func (p *MaskingPolicy) Validate() error {
+	if p.KeyScope != "" && p.KeyScope != KeyScopeBatch && p.KeyScope != KeyScopeUser {
+		return errors.New(fmt.Sprintf("unknown key scope %q", p.KeyScope))
+	}
+
+	for field, fieldPolicy := range p.Fields {
+		if _, ok := responseFields[field]; !ok {
+			return errors.New(fmt.Sprintf("unknown field %q", field))
+		}
+
+		switch fieldPolicy.Action {
+		case ActionEncrypt, ActionHash, ActionTokenize, ActionRedact, ActionPass:
+		case ActionFormatPreserving:
+			// Format-preserving values are all masked with a single data key, an erasure could not shred them.
+			if p.UserKeys() {
+				return errors.New(fmt.Sprintf("action %q of field %v is not supported with key scope %q",
+					fieldPolicy.Action, field, KeyScopeUser))
+			}
+		case ActionTruncate:
+			if fieldPolicy.IPv4PrefixLength < 0 || fieldPolicy.IPv4PrefixLength > 32 ||
+				fieldPolicy.IPv6PrefixLength < 0 || fieldPolicy.IPv6PrefixLength > 128 || fieldPolicy.Length < 0 {
+				return errors.New(fmt.Sprintf("invalid truncate parameters of field %v", field))
+			}
+		default:
+			return errors.New(fmt.Sprintf("unknown action %q of field %v", fieldPolicy.Action, field))
+		}
+	}
+
+	return nil
+}
+
+// Action returns the masking action of the field.
+func (p *MaskingPolicy) Action(field string) string {
+	fieldPolicy, ok := p.Fields[field]
+	if !ok || fieldPolicy.Action == "" {
+		return ActionPass
+	}
+
+	return fieldPolicy.Action
+}
+
+// UserKeys reports whether encrypted fields are masked with the data key of their user.
+func (p *MaskingPolicy) UserKeys() bool {
+	return p.KeyScope == KeyScopeUser
+}
+
+// mask applies the action of the field to its plaintext value, a nil value is returned when it is redacted.
+func (p *MaskingPolicy) mask(ctx context.Context, masker Masker, field string, plaintext string) (*string, error) {
+	var masked string
+	var err error
+
+	switch p.Action(field) {
+	case ActionEncrypt:
+		masked, err = masker.Mask(ctx, field, plaintext)
+	case ActionHash:
+		masked = masker.BlindIndex(field, plaintext)
+	case ActionTokenize:
+		masked, err = masker.Tokenize(ctx, field, plaintext)
+	case ActionFormatPreserving:
+		masked, err = masker.MaskFormatPreserving(ctx, field, plaintext)
+	case ActionTruncate:
+		masked, err = truncate(p.Fields[field], plaintext)
+	case ActionRedact:
+		return nil, nil
+	default:
+		masked = plaintext
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &masked, nil
+}
+
+// unmask recovers the plaintext of a stored value, the inverse being chosen from the format of the value rather than
+// from the current action of the field, which may have changed since it was stored: tokens are detokenized and values
+// carrying a masking version are decrypted. Values without either are legacy AES-CBC values when the field is
+// encrypted and format-preserving values when the field is fpe, the others, hashed, truncated or passed through, are
+// returned as stored. Encrypted values whose data key was shredded are replaced with the ErasedValue, any other
+// failure, e.g. a token deleted from the vault, is returned.
+func (p *MaskingPolicy) unmask(ctx context.Context, masker Masker, field string, masked string) (string, error) {
+	var plaintext string
+	var err error
+
+	version, _, _, versionErr := parseMasked(masked)
+	switch {
+	case strings.HasPrefix(masked, TokenPrefix):
+		plaintext, err = masker.Detokenize(ctx, field, masked)
+	case versionErr == nil && version != MaskingVersionLegacy:
+		plaintext, err = masker.Unmask(ctx, field, masked)
+	case p.Action(field) == ActionEncrypt:
+		plaintext, err = masker.Unmask(ctx, field, masked)
+	case p.Action(field) == ActionFormatPreserving:
+		return masker.UnmaskFormatPreserving(ctx, field, masked)
+	default:
+		return masked, nil
+	}
+
+	if errors.Is(err, ErrDataKeyNotFound) {
+		return ErasedValue, nil
+	}
+
+	return plaintext, err
+}
+
+// ErrNotSearchable is returned when searching a field whose masked values cannot be searched by equality.
+var ErrNotSearchable = errors.New("field is not searchable")
+
+// ErrInvalidValue is returned when a value cannot be masked by the action of its field because of its format, e.g. a
+// device id with too few digits to be format-preserved. Other masking failures, e.g. of the key provider or the vault,
+// are not caused by the value and the value may be masked once retried.
+var ErrInvalidValue = errors.New("value cannot be masked by the action of its field")
+
+// blindIndex returns the blind index stored next to the masked value of the field, nil when the field is not searched
+// through one: hashed and format-preserving values are equal for equal values and searched directly, tokens and
+// redacted values are not searchable. Truncated values are indexed truncated, so that the index does not reveal more
+// of the value than the stored one.
+func (p *MaskingPolicy) blindIndex(masker Masker, field string, plaintext string) *string {
+	switch p.Action(field) {
+	case ActionEncrypt, ActionPass:
+	case ActionTruncate:
+		truncated, err := truncate(p.Fields[field], plaintext)
+		if err != nil {
+			return nil
+		}
+
+		plaintext = truncated
+	default:
+		return nil
+	}
+
+	index := masker.BlindIndex(field, plaintext)
+
+	return &index
+}
+
+// SearchTerm returns the value the logins whose field equals plaintext are searched with, along with whether it is
+// compared with the blind index of the field, see blindIndex, or with its masked value. ErrNotSearchable is returned for
+// tokenized and redacted fields.
+func (p *MaskingPolicy) SearchTerm(ctx context.Context, masker Masker, field string, plaintext string) (string, bool, error) {
+	switch p.Action(field) {
+	case ActionHash:
+		return masker.BlindIndex(field, plaintext), false, nil
+	case ActionFormatPreserving:
+		masked, err := masker.MaskFormatPreserving(ctx, field, plaintext)
+		return masked, false, err
+	case ActionTokenize, ActionRedact:
+		return "", false, fmt.Errorf("%w: %v is %v", ErrNotSearchable, field, p.Action(field))
+	default:
+		index := p.blindIndex(masker, field, plaintext)
+		if index == nil {
+			return "", false, fmt.Errorf("%w: %v cannot be truncated", ErrNotSearchable, plaintext)
+		}
+
+		return *index, true, nil
+	}
+}
+
+// truncate keeps the network prefix of an IP address or the first Length characters of any other value.
+func truncate(fieldPolicy FieldPolicy, value string) (string, error) {
+	addr, err := netip.ParseAddr(value)
+	if err == nil {
+		bits := fieldPolicy.IPv4PrefixLength
+		if bits == 0 {
+			bits = defaultIPv4PrefixLength
+		}
+
+		if addr.Is6() && !addr.Is4In6() {
+			bits = fieldPolicy.IPv6PrefixLength
+			if bits == 0 {
+				bits = defaultIPv6PrefixLength
+			}
+		} else {
+			addr = addr.Unmap()
+		}
+
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+
+		return prefix.Addr().String(), nil
+	}
+
+	if fieldPolicy.Length == 0 {
+		return "", fmt.Errorf("%w: value is not an IP address and no truncate length is set", ErrInvalidValue)
+	}
+
+	runes := []rune(value)
+	if len(runes) > fieldPolicy.Length {
+		runes = runes[:fieldPolicy.Length]
+	}
+
+	return string(runes), nil
+}
+
+// responseField reads and writes a payload field of the Response, nil standing for an empty value.
+type responseField struct {
+	get func(res *Response) *string
+	set func(res *Response, value *string)
+}
+
+// responseFields are the payload fields of the Response a masking policy applies to, by their JSON name.
+var responseFields = map[string]responseField{
+	FieldUserID: {
+		get: func(res *Response) *string { return res.UserID },
+		set: func(res *Response, value *string) { res.UserID = value },
+	},
+	FieldAppVersion: {
+		get: func(res *Response) *string { return nonEmpty(res.AppVersion) },
+		set: func(res *Response, value *string) { res.AppVersion = valueOf(value) },
+	},
+	FieldDeviceType: {
+		get: func(res *Response) *string { return res.DeviceType },
+		set: func(res *Response, value *string) { res.DeviceType = value },
+	},
+	FieldIP: {
+		get: func(res *Response) *string { return res.IP },
+		set: func(res *Response, value *string) { res.IP = value },
+	},
+	FieldLocale: {
+		get: func(res *Response) *string { return nonEmpty(res.Locale) },
+		set: func(res *Response, value *string) { res.Locale = valueOf(value) },
+	},
+	FieldDeviceID: {
+		get: func(res *Response) *string { return res.DeviceID },
+		set: func(res *Response, value *string) { res.DeviceID = value },
+	},
+}
+
+// responseFieldNames returns the names of the responseFields in a stable order.
+func responseFieldNames() []string {
+	names := make([]string, 0, len(responseFields))
+	for name := range responseFields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func nonEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+func valueOf(value *string) string {
+	if value == nil {
+		return ""
+	}
+
+	return *value
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidatePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy MaskingPolicy
+		valid  bool
+	}{
+		{"default policy", *DefaultMaskingPolicy(), true},
+		{"fpe with batch keys", MaskingPolicy{Fields: map[string]FieldPolicy{FieldIP: {Action: ActionFormatPreserving}}}, true},
+		{"encrypt with user keys", MaskingPolicy{KeyScope: KeyScopeUser, Fields: map[string]FieldPolicy{FieldIP: {Action: ActionEncrypt}}}, true},
+		{"fpe with user keys", MaskingPolicy{KeyScope: KeyScopeUser, Fields: map[string]FieldPolicy{FieldIP: {Action: ActionFormatPreserving}}}, false},
+		{"unknown key scope", MaskingPolicy{KeyScope: "tenant"}, false},
+		{"unknown field", MaskingPolicy{Fields: map[string]FieldPolicy{"email": {Action: ActionHash}}}, false},
+		{"unknown action", MaskingPolicy{Fields: map[string]FieldPolicy{FieldIP: {Action: "shuffle"}}}, false},
+		{"invalid prefix length", MaskingPolicy{Fields: map[string]FieldPolicy{FieldIP: {Action: ActionTruncate, IPv4PrefixLength: 33}}}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Validate()
+			if (err == nil) != tc.valid {
+				t.Errorf("Validate = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestMaskInvalidValues(t *testing.T) {
+	key, err := newFPEKey(make([]byte, dataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		mask func() (string, error)
+	}{
+		{"truncate of a value without length", func() (string, error) { return truncate(FieldPolicy{}, "not an ip") }},
+		{"fpe of an invalid ip", func() (string, error) { return formatPreservingIP(key, FieldIP, "not an ip", false) }},
+		{"fpe of too few digits", func() (string, error) { return formatPreservingDigits(key, FieldDeviceID, "ab-123", false) }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.mask()
+			if !errors.Is(err, ErrInvalidValue) {
+				t.Errorf("error %v, want ErrInvalidValue", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Reasons a message is quarantined for.
+const (
+	QuarantineReasonMD5Mismatch = "md5_mismatch"
+	QuarantineReasonInvalidJSON = "invalid_json"
+)
+
+// QuarantinedMessage is a raw SQS message that could not be trusted or parsed, kept aside for inspection.
+type QuarantinedMessage struct {
+	MessageId     *string
+	RequestId     *string
+	MD5OfBody     string
+	RawPayload    string
+	Reason        string
+	ErrorMessage  string
+	QuarantinedAt time.Time
+}
+
+// NewQuarantinedMessage creates a QuarantinedMessage from a message of the SQS message response.
+func NewQuarantinedMessage(requestId *string, message *Message, reason string, errorMessage string) *QuarantinedMessage {
+	return &QuarantinedMessage{
+		MessageId:     message.MessageId,
+		RequestId:     requestId,
+		MD5OfBody:     message.MD5OfBody,
+		RawPayload:    message.Body,
+		Reason:        reason,
+		ErrorMessage:  errorMessage,
+		QuarantinedAt: time.Now().UTC(),
+	}
+}
+
+// BodyMD5 returns the hex encoded MD5 digest of the message body as computed by SQS.
+func (m *Message) BodyMD5() string {
+	digest := md5.Sum([]byte(m.Body))
+
+	return hex.EncodeToString(digest[:])
+}
+
+// VerifyMD5 reports whether the MD5OfBody sent by SQS matches the digest of the received body.
+func (m *Message) VerifyMD5() bool {
+	return strings.EqualFold(m.MD5OfBody, m.BodyMD5())
+}
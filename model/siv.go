@@ -0,0 +1,169 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// sivTagSize is the size of the synthetic IV prepended to every AES-SIV ciphertext.
+const sivTagSize = aes.BlockSize
+
+var errSIVAuthentication = errors.New("aes-siv: message authentication failed")
+
+// sivCipher implements the deterministic authenticated encryption scheme AES-SIV as specified in RFC 5297. The same
+// plaintext and associated data always produce the same ciphertext, which keeps equality of masked values, while any
+// change to the ciphertext is detected when it is opened.
+type sivCipher struct {
+	mac cipher.Block
+	ctr cipher.Block
+}
+
+// newSIV creates an AES-SIV cipher from a 32, 48 or 64 byte key, the first half keys CMAC and the second half CTR.
+func newSIV(key []byte) (*sivCipher, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("aes-siv: key must be 32, 48 or 64 bytes")
+	}
+
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &sivCipher{mac: mac, ctr: ctr}, nil
+}
+
+// Seal encrypts and authenticates the plaintext together with the associated data and returns the synthetic IV
+// followed by the ciphertext.
+func (s *sivCipher) Seal(plaintext []byte, associatedData ...[]byte) []byte {
+	v := s.s2v(plaintext, associatedData)
+
+	out := make([]byte, sivTagSize+len(plaintext))
+	copy(out, v[:])
+	s.xorKeyStream(out[sivTagSize:], plaintext, v)
+
+	return out
+}
+
+// Open decrypts the ciphertext produced by Seal and verifies it against the associated data.
+func (s *sivCipher) Open(ciphertext []byte, associatedData ...[]byte) ([]byte, error) {
+	if len(ciphertext) < sivTagSize {
+		return nil, errSIVAuthentication
+	}
+
+	var v [sivTagSize]byte
+	copy(v[:], ciphertext[:sivTagSize])
+
+	plaintext := make([]byte, len(ciphertext)-sivTagSize)
+	s.xorKeyStream(plaintext, ciphertext[sivTagSize:], v)
+
+	expected := s.s2v(plaintext, associatedData)
+	if subtle.ConstantTimeCompare(expected[:], v[:]) != 1 {
+		return nil, errSIVAuthentication
+	}
+
+	return plaintext, nil
+}
+
+// xorKeyStream applies AES-CTR keyed by the second half of the key, using the synthetic IV with the 31st and 63rd
+// bits cleared as initial counter.
+func (s *sivCipher) xorKeyStream(dst, src []byte, v [sivTagSize]byte) {
+	iv := v
+	iv[8] &= 0x7f
+	iv[12] &= 0x7f
+
+	cipher.NewCTR(s.ctr, iv[:]).XORKeyStream(dst, src)
+}
+
+// s2v derives the synthetic IV from the associated data and the plaintext.
+func (s *sivCipher) s2v(plaintext []byte, associatedData [][]byte) [sivTagSize]byte {
+	var zero [sivTagSize]byte
+	d := cmac(s.mac, zero[:])
+
+	for _, ad := range associatedData {
+		d = dbl(d)
+		mac := cmac(s.mac, ad)
+		xorBlock(d[:], mac[:])
+	}
+
+	var t []byte
+	if len(plaintext) >= sivTagSize {
+		// xorend: xor D into the last block of the plaintext
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		xorBlock(t[len(t)-sivTagSize:], d[:])
+	} else {
+		// dbl(D) xor pad(plaintext)
+		d = dbl(d)
+		padded := make([]byte, sivTagSize)
+		copy(padded, plaintext)
+		padded[len(plaintext)] = 0x80
+		xorBlock(padded, d[:])
+		t = padded
+	}
+
+	return cmac(s.mac, t)
+}
+
+// cmac computes the AES-CMAC of msg as specified in RFC 4493.
+func cmac(block cipher.Block, msg []byte) [aes.BlockSize]byte {
+	var zero, l [aes.BlockSize]byte
+	block.Encrypt(l[:], zero[:])
+	k1 := dbl(l)
+	k2 := dbl(k1)
+
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(msg)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+
+	// Prepare the last block, padded and xored with the matching subkey.
+	var last [aes.BlockSize]byte
+	tail := msg[(n-1)*aes.BlockSize:]
+	copy(last[:], tail)
+	if complete {
+		xorBlock(last[:], k1[:])
+	} else {
+		last[len(tail)] = 0x80
+		xorBlock(last[:], k2[:])
+	}
+
+	var x [aes.BlockSize]byte
+	for i := 0; i < n-1; i++ {
+		xorBlock(x[:], msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x[:], x[:])
+	}
+
+	xorBlock(x[:], last[:])
+	block.Encrypt(x[:], x[:])
+
+	return x
+}
+
+// dbl multiplies the block by x in GF(2^128).
+func dbl(b [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	carry := b[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+
+	out[aes.BlockSize-1] = b[aes.BlockSize-1] << 1
+	out[aes.BlockSize-1] ^= 0x87 * carry
+
+	return out
+}
+
+// xorBlock xors src into dst.
+func xorBlock(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
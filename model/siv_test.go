@@ -0,0 +1,97 @@
+package model
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// TestSIVVectors checks the cipher against the test vectors of RFC 5297 appendix A.
+func TestSIVVectors(t *testing.T) {
+	tests := []struct {
+		name           string
+		key            string
+		associatedData []string
+		plaintext      string
+		ciphertext     string
+	}{
+		{
+			name:           "A.1 deterministic authenticated encryption",
+			key:            "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff",
+			associatedData: []string{"101112131415161718191a1b1c1d1e1f2021222324252627"},
+			plaintext:      "112233445566778899aabbccddee",
+			ciphertext:     "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c",
+		},
+		{
+			name: "A.2 nonce-based authenticated encryption",
+			key:  "7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f",
+			associatedData: []string{
+				"00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100",
+				"102030405060708090a0",
+				// The nonce is the last component of the associated data.
+				"09f911029d74e35bd84156c5635688c0",
+			},
+			plaintext: "7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553",
+			ciphertext: "7bdb6e3b432667eb06f4d14bff2fbd0f" +
+				"cb900f2fddbe404326601965c889bf17dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			siv, err := newSIV(decodeHex(t, tc.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var associatedData [][]byte
+			for _, ad := range tc.associatedData {
+				associatedData = append(associatedData, decodeHex(t, ad))
+			}
+
+			plaintext := decodeHex(t, tc.plaintext)
+			ciphertext := siv.Seal(plaintext, associatedData...)
+			if want := decodeHex(t, tc.ciphertext); !bytes.Equal(ciphertext, want) {
+				t.Fatalf("Seal = %x, want %x", ciphertext, want)
+			}
+
+			opened, err := siv.Open(ciphertext, associatedData...)
+			if err != nil || !bytes.Equal(opened, plaintext) {
+				t.Fatalf("Open = %x, %v, want %x", opened, err, plaintext)
+			}
+
+			// Any change to the ciphertext or to the associated data is detected.
+			for i := range ciphertext {
+				tampered := bytes.Clone(ciphertext)
+				tampered[i] ^= 0x01
+
+				_, err = siv.Open(tampered, associatedData...)
+				if !errors.Is(err, errSIVAuthentication) {
+					t.Fatalf("Open of ciphertext tampered at byte %d = %v, want an authentication error", i, err)
+				}
+			}
+
+			_, err = siv.Open(ciphertext, associatedData[:len(associatedData)-1]...)
+			if !errors.Is(err, errSIVAuthentication) {
+				t.Errorf("Open without the last associated data = %v, want an authentication error", err)
+			}
+
+			_, err = siv.Open(ciphertext[:sivTagSize-1], associatedData...)
+			if !errors.Is(err, errSIVAuthentication) {
+				t.Errorf("Open of a truncated ciphertext = %v, want an authentication error", err)
+			}
+		})
+	}
+}
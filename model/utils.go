@@ -1,41 +1,37 @@
 package model
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
 )
 
-// encrypt encrypts plaintext using AES encryption with the provided key.
-func encrypt(plaintext string, key string) (*string, error) {
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return nil, err
-	}
-
-	plaintextBytes := []byte(plaintext)
-
-	// Padding plaintext if necessary
-	padding := aes.BlockSize - len(plaintextBytes)%aes.BlockSize
-	padText := bytes.Repeat([]byte{byte(padding)}, padding)
-	plaintextBytes = append(plaintextBytes, padText...)
-
-	ciphertext := make([]byte, len(plaintextBytes))
-
-	mode := cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize))
-	mode.CryptBlocks(ciphertext, plaintextBytes)
-
-	encryptedText := base64.StdEncoding.EncodeToString(ciphertext)
-
-	return &encryptedText, nil
-}
+// Errors returned by Decrypt for ciphertexts it cannot decrypt.
+var (
+	// ErrMalformedCiphertext is returned for ciphertexts that are not base64 encoded or whose length is not a non-zero
+	// multiple of the AES block size.
+	ErrMalformedCiphertext = errors.New("malformed ciphertext")
+	// ErrInvalidPadding is returned when the decrypted value does not end with a valid PKCS#7 padding, which is most
+	// likely due to a wrong key.
+	ErrInvalidPadding = errors.New("invalid padding")
+)
 
-// Decrypt decrypts ciphertext using AES decryption with the provided key.
+// Decrypt decrypts a legacy ciphertext encrypted using AES-CBC with an all-zero IV with the provided key. The PKCS#7
+// padding is checked before being removed, so that malformed values and wrong keys return an error.
 func Decrypt(ciphertextStr string, key string) (*string, error) {
 	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextStr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrMalformedCiphertext, err)
+	}
+
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: length %d is not a multiple of %d", ErrMalformedCiphertext, len(ciphertext), aes.BlockSize)
 	}
 
 	block, err := aes.NewCipher([]byte(key))
@@ -50,9 +46,199 @@ func Decrypt(ciphertextStr string, key string) (*string, error) {
 
 	// Remove padding
 	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrInvalidPadding
+	}
+
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return nil, ErrInvalidPadding
+		}
+	}
+
 	decrypted = decrypted[:len(decrypted)-padding]
 
 	plainText := string(decrypted)
 
 	return &plainText, nil
 }
+
+// fpeKey holds the keys of format-preserving masking: the key of the FF1 cipher and the key of the permutation of
+// IPv4 hosts, whose domain is too small for FF1.
+type fpeKey struct {
+	ff1            *ff1Cipher
+	permutationKey []byte
+}
+
+// newFPEKey splits a data key into the keys of format-preserving masking.
+func newFPEKey(key []byte) (*fpeKey, error) {
+	if len(key) != dataKeySize {
+		return nil, errors.New(fmt.Sprintf("format-preserving key must be %d bytes", dataKeySize))
+	}
+
+	ff1, err := newFF1(key[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	return &fpeKey{ff1: ff1, permutationKey: key[32:]}, nil
+}
+
+// formatPreservingIP enciphers an IP address, or deciphers it, into an IP address of the same family. Networks are
+// enciphered on their own, the /24 of IPv4 and the /64 of IPv6 addresses, so that the addresses of a network stay in
+// a single network. The host part is enciphered under a tweak bound to the enciphered network.
+func formatPreservingIP(key *fpeKey, field string, value string, decrypt bool) (string, error) {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+
+	zone := addr.Zone()
+	bytes := addr.WithZone("").AsSlice()
+	networkSize := 8
+	if addr.Is4() {
+		networkSize = 3
+	}
+
+	network := toNumerals(bytes[:networkSize])
+	host := toNumerals(bytes[networkSize:])
+	networkTweak := []byte(fmt.Sprintf("%v/%d", field, networkSize*8))
+
+	// The host is bound to the enciphered network, which is known both when enciphering and deciphering.
+	var maskedNetwork []uint16
+	if decrypt {
+		maskedNetwork = network
+		network, err = key.ff1.Decrypt(network, 256, networkTweak)
+	} else {
+		network, err = key.ff1.Encrypt(network, 256, networkTweak)
+		maskedNetwork = network
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hostTweak := append([]byte(field+"/host/"), fromNumerals(maskedNetwork)...)
+	if addr.Is4() {
+		host[0] = uint16(permuteByte(key.permutationKey, hostTweak, byte(host[0]), decrypt))
+	} else if decrypt {
+		host, err = key.ff1.Decrypt(host, 256, hostTweak)
+	} else {
+		host, err = key.ff1.Encrypt(host, 256, hostTweak)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	result, _ := netip.AddrFromSlice(fromNumerals(append(network, host...)))
+
+	return result.WithZone(zone).String(), nil
+}
+
+// formatPreservingDigits enciphers the digits of a value, or deciphers them, keeping every other character in place
+// so that e.g. a device id keeps its ddd-dd-dddd shape. The value needs at least 6 digits.
+func formatPreservingDigits(key *fpeKey, field string, value string, decrypt bool) (string, error) {
+	runes := []rune(value)
+
+	var positions []int
+	var digits []uint16
+	for i, r := range runes {
+		if r >= '0' && r <= '9' {
+			positions = append(positions, i)
+			digits = append(digits, uint16(r-'0'))
+		}
+	}
+
+	var err error
+	if decrypt {
+		digits, err = key.ff1.Decrypt(digits, 10, []byte(field))
+	} else {
+		digits, err = key.ff1.Encrypt(digits, 10, []byte(field))
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: value has %d digits, at least 6 are required: %v", ErrInvalidValue, len(positions), err.Error())
+	}
+
+	for i, position := range positions {
+		runes[position] = rune('0' + digits[i])
+	}
+
+	return string(runes), nil
+}
+
+// permuteByte maps b through a permutation of all the byte values, or through its inverse, drawn by a Fisher-Yates
+// shuffle from an HMAC-SHA256 stream keyed by key over the tweak.
+//
+// FF1 cannot encipher the host byte of an IPv4 address: NIST SP 800-38G Rev. 1 requires a domain of at least one
+// million values, and enciphering the host together with the network as one FF1 domain would scatter the addresses of
+// a network across networks. A domain this small is instead enciphered by tabulating a whole permutation drawn from a
+// PRF, the prefix cipher of Black and Rogaway, "Ciphers with Arbitrary Finite Domains", CT-RSA 2002: HMAC-SHA256 is
+// the PRF and the rejection sampling keeps every permutation equally likely, so the permutation is as secure as
+// HMAC-SHA256 and, the tweak binding it to the enciphered network, differs for every network. Drawing it takes about
+// ten HMAC computations, close to the cost of enciphering the network with FF1, so it is rebuilt on every call rather
+// than cached for each of the networks.
+func permuteByte(key []byte, tweak []byte, b byte, inverse bool) byte {
+	var stream []byte
+	var counter uint32
+	next := func() byte {
+		if len(stream) == 0 {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(tweak)
+			mac.Write(binary.BigEndian.AppendUint32(nil, counter))
+			stream = mac.Sum(nil)
+			counter++
+		}
+
+		x := stream[0]
+		stream = stream[1:]
+
+		return x
+	}
+
+	var permutation [256]byte
+	for i := range permutation {
+		permutation[i] = byte(i)
+	}
+
+	for i := 255; i > 0; i-- {
+		// Draw j uniformly in [0, i] by rejecting the values above the largest multiple of i+1.
+		n := i + 1
+		limit := 256 - 256%n
+		x := int(next())
+		for x >= limit {
+			x = int(next())
+		}
+
+		j := x % n
+		permutation[i], permutation[j] = permutation[j], permutation[i]
+	}
+
+	if !inverse {
+		return permutation[b]
+	}
+
+	for i, p := range permutation {
+		if p == b {
+			return byte(i)
+		}
+	}
+
+	return b
+}
+
+func toNumerals(bytes []byte) []uint16 {
+	numerals := make([]uint16, len(bytes))
+	for i, b := range bytes {
+		numerals[i] = uint16(b)
+	}
+
+	return numerals
+}
+
+func fromNumerals(numerals []uint16) []byte {
+	bytes := make([]byte, len(numerals))
+	for i, numeral := range numerals {
+		bytes[i] = byte(numeral)
+	}
+
+	return bytes
+}
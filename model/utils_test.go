@@ -0,0 +1,58 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestDecryptErrors(t *testing.T) {
+	const key = "0123456789abcdef"
+	valid := legacyEncrypt(t, "192.168.1.1", key)
+
+	tests := []struct {
+		name       string
+		ciphertext string
+		key        string
+		want       error
+	}{
+		{"not base64", "not base64!", key, ErrMalformedCiphertext},
+		{"empty", "", key, ErrMalformedCiphertext},
+		{"not a multiple of the block size", base64.StdEncoding.EncodeToString(make([]byte, 20)), key, ErrMalformedCiphertext},
+		{"wrong key", valid, "fedcba9876543210", ErrInvalidPadding},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext, err := Decrypt(tc.ciphertext, tc.key)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Decrypt = %q, %v, want %v", valueOf(plaintext), err, tc.want)
+			}
+		})
+	}
+
+	plaintext, err := Decrypt(valid, key)
+	if err != nil || *plaintext != "192.168.1.1" {
+		t.Errorf("Decrypt = %q, %v, want 192.168.1.1", valueOf(plaintext), err)
+	}
+}
+
+func TestPermuteByteIsABijection(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, tweak := range []string{"ip/host/\x0a\x00\x00", "ip/host/\x0a\x00\x01"} {
+		seen := make(map[byte]bool)
+		for i := 0; i < 256; i++ {
+			permuted := permuteByte(key, []byte(tweak), byte(i), false)
+			if seen[permuted] {
+				t.Fatalf("%q: %d is the image of two bytes", tweak, permuted)
+			}
+
+			seen[permuted] = true
+
+			if inverse := permuteByte(key, []byte(tweak), permuted, true); inverse != byte(i) {
+				t.Fatalf("%q: inverse of %d is %d, want %d", tweak, permuted, inverse, i)
+			}
+		}
+	}
+}
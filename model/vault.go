@@ -0,0 +1,31 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTokenNotFound is returned by a Vault when no entry has the requested token, e.g. once it was deleted.
+var ErrTokenNotFound = errors.New("token not found in the vault")
+
+// VaultEntry maps a surrogate token to the value it stands for. The value is kept masked by the Masker and found by
+// its keyed index, so that a value tokenized twice gets the same token.
+type VaultEntry struct {
+	Token       string
+	Field       string
+	ValueIndex  string
+	MaskedValue string
+	CreatedAt   time.Time
+}
+
+// Vault stores the values swapped for surrogate tokens by the tokenize masking action. Deleting an entry makes the
+// value irrecoverable wherever its token is stored.
+type Vault interface {
+	// Store stores the entry unless the value of the field is already tokenized, the token of the value is returned.
+	Store(ctx context.Context, entry *VaultEntry) (string, error)
+	// Get returns the entry of the token.
+	Get(ctx context.Context, token string) (*VaultEntry, error)
+	// Delete deletes the entry of the token, the logins holding the token lose their blind index of the value.
+	Delete(ctx context.Context, token string) error
+}